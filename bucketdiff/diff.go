@@ -0,0 +1,220 @@
+// Package bucketdiff compares VBase and Metadata buckets across workspaces and
+// replays the differences onto other workspaces.
+package bucketdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/vtex/go-clients/metadata"
+	"github.com/vtex/go-clients/vbase"
+	"github.com/vtex/go-clients/watch"
+)
+
+// Options configures a diff
+type Options struct {
+	// ContentDiffs computes line diffs for changed text and JSON entries
+	ContentDiffs bool
+	// MaxContentBytes skips content diffs of entries larger than this size.
+	// Defaults to 1MB.
+	MaxContentBytes int
+}
+
+// Result lists the entries that differ between a source and a destination
+// bucket. Paths are added when they only exist in the source and removed
+// when they only exist in the destination.
+type Result struct {
+	Bucket  string
+	Added   []string
+	Removed []string
+	Changed []string
+	// ContentDiffs holds line diffs from destination to source, keyed by path
+	ContentDiffs map[string]string
+}
+
+// VBaseDiff is the difference between two VBase buckets
+type VBaseDiff struct {
+	Result
+	Prefix string
+	src    vbase.VBase
+}
+
+// MetadataDiff is the difference between two Metadata buckets
+type MetadataDiff struct {
+	Result
+	values map[string]json.RawMessage
+}
+
+func (o *Options) setDefaults() {
+	if o.MaxContentBytes <= 0 {
+		o.MaxContentBytes = 1 << 20
+	}
+}
+
+// DiffVBase compares the files under prefix in a bucket of src and dst
+func DiffVBase(src, dst vbase.VBase, bucket, prefix string, opts Options) (*VBaseDiff, error) {
+	opts.setDefaults()
+	srcHashes, err := vbaseHashes(src, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	dstHashes, err := vbaseHashes(dst, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &VBaseDiff{Result: newResult(bucket, dstHashes, srcHashes), Prefix: prefix, src: src}
+	if opts.ContentDiffs {
+		for _, path := range diff.Changed {
+			srcContent, contentType, err := readFile(src, bucket, path)
+			if err != nil {
+				return nil, err
+			}
+			dstContent, _, err := readFile(dst, bucket, path)
+			if err != nil {
+				return nil, err
+			}
+			if isText(contentType) && len(srcContent) <= opts.MaxContentBytes && len(dstContent) <= opts.MaxContentBytes {
+				diff.ContentDiffs[path] = contentDiff(dstContent, srcContent, isJSON(contentType))
+			}
+		}
+	}
+	return diff, nil
+}
+
+// Apply replays the diff onto target, copying added and changed files from
+// the diff's source and deleting removed ones.
+func (d *VBaseDiff) Apply(target vbase.VBase) error {
+	for _, path := range append(append([]string{}, d.Added...), d.Changed...) {
+		err := vbase.Copy(
+			vbase.Location{Client: d.src, Bucket: d.Bucket, Path: path},
+			vbase.Location{Client: target, Bucket: d.Bucket, Path: path},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range d.Removed {
+		if err := target.DeleteFile(d.Bucket, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffMetadata compares the keys in a bucket of src and dst
+func DiffMetadata(src, dst metadata.Metadata, bucket string, opts Options) (*MetadataDiff, error) {
+	opts.setDefaults()
+	srcList, _, err := src.ListAll(bucket, true)
+	if err != nil {
+		return nil, err
+	}
+	dstList, _, err := dst.ListAll(bucket, opts.ContentDiffs)
+	if err != nil {
+		return nil, err
+	}
+
+	srcHashes, srcValues := metadataEntries(srcList)
+	dstHashes, dstValues := metadataEntries(dstList)
+	diff := &MetadataDiff{Result: newResult(bucket, dstHashes, srcHashes), values: srcValues}
+	if opts.ContentDiffs {
+		for _, key := range diff.Changed {
+			srcValue, dstValue := srcValues[key], dstValues[key]
+			if len(srcValue) <= opts.MaxContentBytes && len(dstValue) <= opts.MaxContentBytes {
+				diff.ContentDiffs[key] = contentDiff(dstValue, srcValue, true)
+			}
+		}
+	}
+	return diff, nil
+}
+
+// Apply replays the diff onto target, saving the source values of added and
+// changed keys, as of when the diff was computed, and deleting removed keys.
+func (d *MetadataDiff) Apply(target metadata.Metadata) error {
+	var patch metadata.MetadataPatchRequest
+	for _, key := range append(append([]string{}, d.Added...), d.Changed...) {
+		patch = append(patch, &metadata.PatchOperation{Type: metadata.OperationTypeReplace, Key: key, Value: d.values[key]})
+	}
+	for _, key := range d.Removed {
+		patch = append(patch, &metadata.PatchOperation{Type: metadata.OperationTypeRemove, Key: key})
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+	return target.DoAll(d.Bucket, patch)
+}
+
+func newResult(bucket string, dstHashes, srcHashes map[string]string) Result {
+	result := Result{Bucket: bucket, ContentDiffs: map[string]string{}}
+	for _, e := range watch.Diff(dstHashes, srcHashes) {
+		switch e.Type {
+		case watch.Added:
+			result.Added = append(result.Added, e.Key)
+		case watch.Deleted:
+			result.Removed = append(result.Removed, e.Key)
+		case watch.Modified:
+			result.Changed = append(result.Changed, e.Key)
+		}
+	}
+	return result
+}
+
+func vbaseHashes(client vbase.VBase, bucket, prefix string) (map[string]string, error) {
+	list, _, err := client.ListAllFiles(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string, len(list.Files))
+	for _, f := range list.Files {
+		hashes[f.Path] = f.Hash
+	}
+	return hashes, nil
+}
+
+func metadataEntries(list *metadata.MetadataListResponse) (map[string]string, map[string]json.RawMessage) {
+	hashes := make(map[string]string, len(list.Data))
+	values := make(map[string]json.RawMessage, len(list.Data))
+	for _, entry := range list.Data {
+		hashes[entry.Key] = entry.Hash
+		values[entry.Key] = entry.Value
+	}
+	return hashes, values
+}
+
+func readFile(client vbase.VBase, bucket, path string) ([]byte, string, error) {
+	file, contentType, err := client.GetFile(bucket, path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	return content, contentType, err
+}
+
+func isText(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || isJSON(contentType)
+}
+
+func isJSON(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// contentDiff diffs two contents line by line. JSON documents are indented
+// first so that changes show up in separate lines.
+func contentDiff(from, to []byte, indentJSON bool) string {
+	if indentJSON {
+		from, to = indent(from), indent(to)
+	}
+	return lineDiff(strings.Split(string(from), "\n"), strings.Split(string(to), "\n"))
+}
+
+func indent(content []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, content, "", "  "); err != nil {
+		return content
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,83 @@
+package bucketdiff
+
+import "strings"
+
+// maxLCSCells bounds the size of the LCS table computed by lineDiff
+const maxLCSCells = 1 << 22
+
+// lineDiff returns the lines of from and to prefixed by "-" if removed, "+" if
+// added or " " if kept, based on their longest common subsequence. Common
+// leading and trailing lines are skipped from the LCS, and when the lines left
+// would need a table larger than maxLCSCells, they are all shown as removed
+// then added.
+func lineDiff(from, to []string) string {
+	var out []string
+	for len(from) > 0 && len(to) > 0 && from[0] == to[0] {
+		out = append(out, " "+from[0])
+		from, to = from[1:], to[1:]
+	}
+	var tail []string
+	for len(from) > 0 && len(to) > 0 && from[len(from)-1] == to[len(to)-1] {
+		tail = append(tail, " "+from[len(from)-1])
+		from, to = from[:len(from)-1], to[:len(to)-1]
+	}
+
+	if int64(len(from)+1)*int64(len(to)+1) > maxLCSCells {
+		for _, line := range from {
+			out = append(out, "-"+line)
+		}
+		for _, line := range to {
+			out = append(out, "+"+line)
+		}
+	} else {
+		out = lcsDiff(out, from, to)
+	}
+
+	for i := len(tail) - 1; i >= 0; i-- {
+		out = append(out, tail[i])
+	}
+	return strings.Join(out, "\n")
+}
+
+// lcsDiff appends the diff of from and to to out
+func lcsDiff(out, from, to []string) []string {
+	// lcs[i][j] is the LCS length of from[i:] and to[j:]
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		switch {
+		case from[i] == to[j]:
+			out = append(out, " "+from[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+from[i])
+			i++
+		default:
+			out = append(out, "+"+to[j])
+			j++
+		}
+	}
+	for ; i < len(from); i++ {
+		out = append(out, "-"+from[i])
+	}
+	for ; j < len(to); j++ {
+		out = append(out, "+"+to[j])
+	}
+	return out
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+
+	"github.com/pkg/errors"
 )
 
 type NoUserAgentError struct {
@@ -34,3 +36,17 @@ func (err ResponseError) Error() string {
 	}
 	return fmt.Sprintf("(%d %v at %v) %v", err.StatusCode, err.Code, url, err.Message)
 }
+
+// IsNotFound tells whether err, or the error it wraps, is a ResponseError with
+// a 404 status
+func IsNotFound(err error) bool {
+	respErr, ok := errors.Cause(err).(ResponseError)
+	return ok && respErr.StatusCode == http.StatusNotFound
+}
+
+// IsPreconditionFailed tells whether err, or the error it wraps, is a
+// ResponseError with a 412 status
+func IsPreconditionFailed(err error) bool {
+	respErr, ok := errors.Cause(err).(ResponseError)
+	return ok && respErr.StatusCode == http.StatusPreconditionFailed
+}
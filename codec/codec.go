@@ -0,0 +1,116 @@
+// Package codec provides the serialization formats used by typed stores on top
+// of VBase and Metadata.
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Codec serializes values to and from bytes
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes values as plain JSON
+	JSON Codec = jsonCodec{}
+	// GzipJSON encodes values as gzip compressed JSON
+	GzipJSON Codec = gzipJSONCodec{}
+	// Gob encodes values in Go's compact binary gob format
+	Gob Codec = gobCodec{}
+)
+
+// ToJSON encodes v with c into a JSON document suitable for APIs that only
+// store JSON. Values encoded by binary codecs are stored as base64 strings.
+func ToJSON(c Codec, v interface{}) (json.RawMessage, error) {
+	data, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.(jsonCodec); ok {
+		return data, nil
+	}
+	return json.Marshal(data)
+}
+
+// FromJSON decodes a JSON document produced by ToJSON into v
+func FromJSON(c Codec, raw json.RawMessage, v interface{}) error {
+	if _, ok := c.(jsonCodec); ok {
+		return c.Unmarshal(raw, v)
+	}
+	var data []byte
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return err
+	}
+	return c.Unmarshal(data, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gzipJSONCodec struct{}
+
+func (gzipJSONCodec) Name() string {
+	return "gzip-json"
+}
+
+func (gzipJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(v); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	buf, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,11 @@
+package common
+
+// BucketState is the lifecycle state of a VBase or Metadata bucket. States
+// other than the ones declared here may be returned by newer services.
+type BucketState string
+
+const (
+	BucketStateActive   = BucketState("active")
+	BucketStateReadOnly = BucketState("readonly")
+	BucketStateDisabled = BucketState("disabled")
+)
@@ -0,0 +1,230 @@
+// Package expiring emulates entries with a time to live on top of VBase and
+// Metadata. Values are stored along with their expiration and are reported as
+// not found once expired, until a Sweeper deletes them.
+package expiring
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/metadata"
+	"github.com/vtex/go-clients/vbase"
+)
+
+// Options configures a Store
+type Options struct {
+	// Prefix restricts a VBase store to files under a path prefix, which is
+	// prepended to every key. It is ignored by Metadata stores.
+	Prefix string
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Store saves JSON values that expire after a TTL
+type Store struct {
+	backend backend
+	bucket  string
+	now     func() time.Time
+}
+
+// envelope is the stored document, wrapping a value with its expiration. A
+// zero ExpiresAt never expires.
+type envelope struct {
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Value     json.RawMessage `json:"value"`
+}
+
+func (e *envelope) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// listedEntry is an entry found while listing a bucket. Value is nil if the
+// backend didn't list its content.
+type listedEntry struct {
+	key   string
+	value json.RawMessage
+}
+
+type backend interface {
+	get(bucket, key string, env *envelope) (string, error)
+	save(bucket, key string, env *envelope) (string, error)
+	delete(bucket, key string) error
+	// deleteExpired deletes keys unless they changed since they had the
+	// given ETags, returning how many were deleted. Backends without
+	// conditional deletes delete them unconditionally.
+	deleteExpired(bucket string, keys, eTags []string) (int, error)
+	list(bucket, marker string, limit int) ([]listedEntry, string, error)
+}
+
+// NewVBaseStore creates a Store saving values as JSON files in a VBase bucket
+func NewVBaseStore(client vbase.VBase, bucket string, opts Options) *Store {
+	return newStore(&vbaseBackend{client, opts.Prefix}, bucket, opts)
+}
+
+// NewMetadataStore creates a Store saving values as keys of a Metadata bucket
+func NewMetadataStore(client metadata.Metadata, bucket string, opts Options) *Store {
+	return newStore(&metadataBackend{client}, bucket, opts)
+}
+
+func newStore(b backend, bucket string, opts Options) *Store {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Store{backend: b, bucket: bucket, now: opts.Now}
+}
+
+// Get populates data with the value at key. Expired values fail with the same
+// not found error as missing ones.
+func (s *Store) Get(key string, data interface{}) (string, error) {
+	var env envelope
+	eTag, err := s.backend.get(s.bucket, key, &env)
+	if err != nil {
+		return "", err
+	}
+	if env.expired(s.now()) {
+		return "", clients.ResponseError{
+			StatusCode: http.StatusNotFound,
+			Code:       "expired",
+			Message:    "Entry " + key + " expired at " + env.ExpiresAt.Format(time.RFC3339),
+		}
+	}
+	if err := json.Unmarshal(env.Value, data); err != nil {
+		return "", err
+	}
+	return eTag, nil
+}
+
+// Put saves data at key, expiring after ttl. A ttl of zero never expires.
+func (s *Store) Put(key string, data interface{}, ttl time.Duration) (string, error) {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	env := &envelope{Value: value}
+	if ttl > 0 {
+		env.ExpiresAt = s.now().Add(ttl)
+	}
+	return s.backend.save(s.bucket, key, env)
+}
+
+// Delete removes the value at key
+func (s *Store) Delete(key string) error {
+	return s.backend.delete(s.bucket, key)
+}
+
+// IsNotFound tells whether err means an entry is missing or expired
+func IsNotFound(err error) bool {
+	return clients.IsNotFound(err)
+}
+
+func isPreconditionFailed(err error) bool {
+	respErr, ok := errors.Cause(err).(clients.ResponseError)
+	return ok && respErr.StatusCode == http.StatusPreconditionFailed
+}
+
+type vbaseBackend struct {
+	client vbase.VBase
+	prefix string
+}
+
+func (b *vbaseBackend) get(bucket, key string, env *envelope) (string, error) {
+	return b.client.GetJSON(bucket, b.prefix+key, env)
+}
+
+func (b *vbaseBackend) save(bucket, key string, env *envelope) (string, error) {
+	return b.client.SaveJSON(bucket, b.prefix+key, env)
+}
+
+func (b *vbaseBackend) delete(bucket, key string) error {
+	return b.client.DeleteFile(bucket, b.prefix+key)
+}
+
+func (b *vbaseBackend) deleteExpired(bucket string, keys, eTags []string) (int, error) {
+	deleter, conditional := b.client.(vbase.ConditionalDeleter)
+	deleted := 0
+	for i, key := range keys {
+		var err error
+		if conditional {
+			err = deleter.DeleteFileIfMatch(bucket, b.prefix+key, eTags[i])
+		} else {
+			err = b.delete(bucket, key)
+		}
+		if IsNotFound(err) || isPreconditionFailed(err) {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (b *vbaseBackend) list(bucket, marker string, limit int) ([]listedEntry, string, error) {
+	list, _, err := b.client.ListFiles(bucket, &vbase.Options{Prefix: b.prefix, Marker: marker, Limit: limit})
+	if err != nil {
+		return nil, "", err
+	}
+	entries := make([]listedEntry, 0, len(list.Files))
+	for _, file := range list.Files {
+		if strings.HasPrefix(file.Path, b.prefix) {
+			entries = append(entries, listedEntry{strings.TrimPrefix(file.Path, b.prefix), file.Value})
+		}
+	}
+	return entries, list.NextMarker, nil
+}
+
+type metadataBackend struct {
+	client metadata.Metadata
+}
+
+func (b *metadataBackend) get(bucket, key string, env *envelope) (string, error) {
+	return b.client.Get(bucket, key, env)
+}
+
+func (b *metadataBackend) save(bucket, key string, env *envelope) (string, error) {
+	return b.client.Save(bucket, key, env)
+}
+
+func (b *metadataBackend) delete(bucket, key string) error {
+	_, err := b.client.Delete(bucket, key)
+	return err
+}
+
+func (b *metadataBackend) deleteExpired(bucket string, keys, eTags []string) (int, error) {
+	deleter, conditional := b.client.(metadata.ConditionalDeleter)
+	deleted := 0
+	for i, key := range keys {
+		var ok bool
+		var err error
+		if conditional {
+			ok, err = deleter.DeleteIfMatch(bucket, key, eTags[i])
+		} else {
+			ok, err = b.client.Delete(bucket, key)
+		}
+		if isPreconditionFailed(err) {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (b *metadataBackend) list(bucket, marker string, limit int) ([]listedEntry, string, error) {
+	list, _, err := b.client.List(bucket, &metadata.Options{IncludeValue: true, Limit: limit, Marker: marker})
+	if err != nil {
+		return nil, "", err
+	}
+	entries := make([]listedEntry, len(list.Data))
+	for i, entry := range list.Data {
+		entries[i] = listedEntry{entry.Key, entry.Value}
+	}
+	return entries, list.NextMarker, nil
+}
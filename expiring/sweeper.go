@@ -0,0 +1,160 @@
+package expiring
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// SweepOptions configures a Sweeper
+type SweepOptions struct {
+	// BatchSize is how many keys are listed, and expired ones deleted, at a
+	// time. Defaults to 100.
+	BatchSize int
+	// Rate bounds how many keys are deleted per second. Zero means no limit.
+	Rate float64
+	// OnSweep, if set, is called by Run after every sweep
+	OnSweep func(stats SweepStats, err error)
+}
+
+// SweepStats counts what a sweep found
+type SweepStats struct {
+	// Scanned is how many keys were listed
+	Scanned int
+	// Expired is how many of them were expired
+	Expired int
+	// Reclaimed is how many expired keys were deleted
+	Reclaimed int
+	Duration  time.Duration
+}
+
+// Sweeper deletes the expired entries of a Store
+type Sweeper struct {
+	store *Store
+	opts  SweepOptions
+}
+
+// NewSweeper creates a Sweeper for store
+func NewSweeper(store *Store, opts SweepOptions) *Sweeper {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	return &Sweeper{store: store, opts: opts}
+}
+
+// Run sweeps every interval until ctx is done
+func (w *Sweeper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stats, err := w.Sweep(ctx)
+		if w.opts.OnSweep != nil {
+			w.opts.OnSweep(stats, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep pages through the store's bucket once, deleting the expired keys.
+// Expired keys are read again right before deletion, and only deleted if
+// unchanged since, when the client supports conditional deletes, so that keys
+// written meanwhile are kept.
+func (w *Sweeper) Sweep(ctx context.Context) (stats SweepStats, err error) {
+	start := time.Now()
+	defer func() {
+		stats.Duration = time.Since(start)
+	}()
+
+	marker := ""
+	for {
+		entries, next, err := w.store.backend.list(w.store.bucket, marker, w.opts.BatchSize)
+		if err != nil {
+			return stats, err
+		}
+		stats.Scanned += len(entries)
+
+		expired, eTags, err := w.expiredKeys(entries)
+		if err != nil {
+			return stats, err
+		}
+		stats.Expired += len(expired)
+
+		if len(expired) > 0 {
+			if err := w.wait(ctx, len(expired)); err != nil {
+				return stats, err
+			}
+			deleted, err := w.store.backend.deleteExpired(w.store.bucket, expired, eTags)
+			stats.Reclaimed += deleted
+			if err != nil {
+				return stats, err
+			}
+		}
+
+		if next == "" {
+			return stats, nil
+		}
+		marker = next
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+	}
+}
+
+// expiredKeys returns the expired keys among entries, along with the ETags
+// they had when read again
+func (w *Sweeper) expiredKeys(entries []listedEntry) ([]string, []string, error) {
+	now := w.store.now()
+	var expired, eTags []string
+	for _, entry := range entries {
+		if entry.value != nil {
+			var env envelope
+			if err := json.Unmarshal(entry.value, &env); err != nil || !env.expired(now) {
+				// Not written by a Store, or still valid
+				continue
+			}
+		}
+
+		var env envelope
+		eTag, err := w.store.backend.get(w.store.bucket, entry.key, &env)
+		if IsNotFound(err) || isDecodeError(err) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if env.expired(w.store.now()) {
+			expired = append(expired, entry.key)
+			eTags = append(eTags, eTag)
+		}
+	}
+	return expired, eTags, nil
+}
+
+// isDecodeError tells whether err comes from decoding content that wasn't
+// written by a Store
+func isDecodeError(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return false
+}
+
+// wait delays deleting n keys to respect the configured rate
+func (w *Sweeper) wait(ctx context.Context, n int) error {
+	if w.opts.Rate <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(time.Duration(float64(n) / w.opts.Rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,168 @@
+// Package fsutil holds the helpers shared by the filesystem backed VBase and
+// Metadata implementations and the packages transferring local files.
+package fsutil
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/common"
+)
+
+const (
+	// LockFile is the name of the lock file in every bucket directory
+	LockFile = ".lock"
+	// BucketFile is the name of the bucket description in every bucket
+	// directory
+	BucketFile = ".bucket.json"
+)
+
+// Bucket is the persisted description of a bucket
+type Bucket struct {
+	Hash  string             `json:"hash"`
+	State common.BucketState `json:"state"`
+}
+
+// emptyHash is the hash of buckets never written
+const emptyHash = "d41d8cd98f00b204e9800998ecf8427e"
+
+// ReadBucket reads the description of the bucket at dir. Buckets never
+// written are active.
+func ReadBucket(dir string) (*Bucket, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, BucketFile))
+	if os.IsNotExist(err) {
+		return &Bucket{Hash: emptyHash, State: common.BucketStateActive}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var b Bucket
+	if err := json.Unmarshal(content, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// WriteBucket persists the description of the bucket at dir
+func WriteBucket(dir string, b *Bucket) error {
+	content, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(dir, BucketFile), content)
+}
+
+// TouchBucket gives the bucket at dir a new hash, after its content changed
+func TouchBucket(dir string) error {
+	b, err := ReadBucket(dir)
+	if err != nil {
+		return err
+	}
+	b.Hash = NewHash()
+	return WriteBucket(dir, b)
+}
+
+// LockBucket locks the bucket at dir, creating its directory if needed
+func LockBucket(dir string, exclusive bool) (unlock func(), err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return Lock(filepath.Join(dir, LockFile), exclusive)
+}
+
+// WriteFileAtomic writes a file through a temporary file renamed over it, so
+// that readers never see partial content. Parent directories are created.
+func WriteFileAtomic(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// RemoveEmptyDirs removes dir and its parents while they are empty, stopping
+// at root
+func RemoveEmptyDirs(dir, root string) {
+	for dir != root && len(dir) > len(root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// ListDirs returns the names of the directories in dir, or none if it doesn't
+// exist
+func ListDirs(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// ContentHash returns the hex encoded MD5 of content, the format of VBase
+// ETags
+func ContentHash(content []byte) string {
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewHash returns a random bucket hash
+func NewHash() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NotFound is the error returned for missing files and keys, as by the
+// services
+func NotFound(message string) error {
+	return clients.ResponseError{StatusCode: http.StatusNotFound, Code: "NotFound", Message: message}
+}
+
+// CheckName rejects bucket and app names that aren't a single directory name,
+// so that they can't point outside of the backend's root
+func CheckName(name string) error {
+	if name == "" || name == "." || strings.Contains(name, "..") || strings.ContainsAny(name, `/\`) {
+		return BadRequest("Invalid name " + name)
+	}
+	return nil
+}
+
+// BadRequest is the error returned for invalid requests
+func BadRequest(message string) error {
+	return clients.ResponseError{StatusCode: http.StatusBadRequest, Code: "BadRequest", Message: message}
+}
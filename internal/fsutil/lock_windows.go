@@ -0,0 +1,33 @@
+//go:build windows
+
+package fsutil
+
+import (
+	"os"
+	"time"
+)
+
+// staleLock is the age after which a lock file left by a crashed process is
+// removed
+const staleLock = time.Minute
+
+// Lock takes a lock on path by exclusively creating a ".excl" file next to
+// it, blocking until it is acquired. Every lock is exclusive.
+func Lock(path string, exclusive bool) (unlock func(), err error) {
+	exclPath := path + ".excl"
+	for {
+		f, err := os.OpenFile(exclPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(exclPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(exclPath); statErr == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(exclPath)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,31 @@
+package fsutil
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchPath tells whether a slash separated path is selected by include and
+// exclude glob patterns (see path.Match). Patterns without a slash are also
+// matched against the path's base name. When include is empty, every path not
+// excluded is selected.
+func MatchPath(include, exclude []string, name string) bool {
+	if len(include) > 0 && !matchAny(include, name) {
+		return false
+	}
+	return !matchAny(exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(name)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
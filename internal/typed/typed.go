@@ -0,0 +1,95 @@
+// Package typed holds the logic shared by the typed stores of VBase and
+// Metadata, on top of the raw JSON documents each of them stores.
+package typed
+
+import (
+	"encoding/json"
+
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/codec"
+)
+
+// maxUpdateAttempts bounds how many times Update reads and saves a value
+// changed concurrently
+const maxUpdateAttempts = 10
+
+// Condition restricts a save to a known state of the key
+type Condition struct {
+	// IfMatch, if set, only saves the value if the key's ETag still matches it
+	IfMatch string
+	// IfNotExists only saves the value if the key doesn't exist
+	IfNotExists bool
+}
+
+// Backend reads and writes the documents of a store. Saves with a condition
+// that doesn't hold fail with a precondition failed error.
+type Backend interface {
+	Get(key string) (json.RawMessage, string, error)
+	Save(key string, raw json.RawMessage, cond Condition) (string, error)
+}
+
+// Store encodes and validates values of type T stored in a Backend
+type Store[T any] struct {
+	Backend  Backend
+	Codec    codec.Codec
+	Validate func(key string, value T) error
+}
+
+// Get decodes the value stored at key
+func (s *Store[T]) Get(key string) (T, string, error) {
+	var value T
+	raw, eTag, err := s.Backend.Get(key)
+	if err != nil {
+		return value, "", err
+	}
+	if value, err = s.Decode(raw); err != nil {
+		return value, "", err
+	}
+	return value, eTag, nil
+}
+
+// Decode decodes a stored document
+func (s *Store[T]) Decode(raw json.RawMessage) (T, error) {
+	var value T
+	err := codec.FromJSON(s.Codec, raw, &value)
+	return value, err
+}
+
+// Put validates and saves value at key
+func (s *Store[T]) Put(key string, value T) (string, error) {
+	return s.save(key, value, Condition{})
+}
+
+// Update reads the value at key, applies mutate and saves the result only if
+// the key didn't change meanwhile. Otherwise, the update is retried with the
+// new value, so mutate may be called more than once.
+func (s *Store[T]) Update(key string, mutate func(value T, exists bool) (T, error)) (T, string, error) {
+	for attempt := 1; ; attempt++ {
+		value, eTag, err := s.Get(key)
+		exists := err == nil
+		if err != nil && !clients.IsNotFound(err) {
+			return value, "", err
+		}
+
+		if value, err = mutate(value, exists); err != nil {
+			return value, "", err
+		}
+		eTag, err = s.save(key, value, Condition{IfMatch: eTag, IfNotExists: !exists})
+		if !clients.IsPreconditionFailed(err) || attempt == maxUpdateAttempts {
+			return value, eTag, err
+		}
+	}
+}
+
+func (s *Store[T]) save(key string, value T, cond Condition) (string, error) {
+	if s.Validate != nil {
+		if err := s.Validate(key, value); err != nil {
+			return "", err
+		}
+	}
+	raw, err := codec.ToJSON(s.Codec, value)
+	if err != nil {
+		return "", err
+	}
+	return s.Backend.Save(key, raw, cond)
+}
@@ -0,0 +1,284 @@
+// Package backup dumps Metadata buckets to JSON Lines and restores them, for
+// disaster recovery or to seed other accounts and workspaces.
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vtex/go-clients/metadata"
+)
+
+// Entry is a line of a dump. Hash is the hash reported by Metadata when the
+// key was dumped, for reference only, since hashes may differ across
+// accounts and workspaces.
+type Entry struct {
+	Key   string          `json:"key"`
+	Hash  string          `json:"hash"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Mode tells what Restore does with keys missing from the dump
+type Mode string
+
+const (
+	// ModeMerge keeps the keys of the bucket missing from the dump
+	ModeMerge = Mode("merge")
+	// ModeReplace deletes the keys of the bucket missing from the dump, so
+	// that the bucket ends up equal to it
+	ModeReplace = Mode("replace")
+)
+
+const defaultPageSize = 100
+
+// RestoreOptions configures Restore
+type RestoreOptions struct {
+	// Filter, if set, selects the keys to restore. In ModeReplace, keys of the
+	// bucket not selected are kept as well.
+	Filter func(key string) bool
+	// ChunkSize is the number of keys saved per request. Defaults to 100.
+	ChunkSize int
+	// Concurrency is the maximum number of simultaneous deletions in
+	// ModeReplace. Defaults to 8.
+	Concurrency int
+	// SkipVerify skips comparing the restored keys' values with the dump.
+	SkipVerify bool
+}
+
+// RestoreResult counts the keys handled by Restore
+type RestoreResult struct {
+	Restored int
+	Skipped  int
+	Removed  int
+}
+
+// Dump writes every key in bucket to w, one JSON encoded Entry per line,
+// returning the number of keys written. Keys are read in pages, so the dump
+// isn't a snapshot of a bucket modified meanwhile.
+func Dump(client metadata.Metadata, bucket string, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	count := 0
+	marker := ""
+	for {
+		list, _, err := client.List(bucket, &metadata.Options{IncludeValue: true, Limit: defaultPageSize, Marker: marker})
+		if err != nil {
+			return count, err
+		}
+		for _, entry := range list.Data {
+			if err := enc.Encode(&Entry{Key: entry.Key, Hash: entry.Hash, Value: entry.Value}); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if list.NextMarker == "" || len(list.Data) == 0 {
+			return count, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+// Restore saves the keys dumped to r into bucket. Unless opts.SkipVerify is
+// set, the values of the restored keys are then read back and compared with
+// the dump, as JSON, so that formatting differences are ignored.
+func Restore(client metadata.Metadata, r io.Reader, bucket string, mode Mode, opts RestoreOptions) (*RestoreResult, error) {
+	if mode != ModeMerge && mode != ModeReplace {
+		return nil, fmt.Errorf("Unknown restore mode: %s", mode)
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultPageSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+
+	result := &RestoreResult{}
+	digests := map[string]string{}
+	chunk := map[string]interface{}{}
+	restored := map[string]bool{}
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if _, err := client.SaveAll(bucket, chunk); err != nil {
+			return err
+		}
+		for key := range chunk {
+			restored[key] = true
+		}
+		result.Restored = len(restored)
+		chunk = map[string]interface{}{}
+		return nil
+	}
+
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var entry Entry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return result, fmt.Errorf("Error decoding dump entry %d: %v", line, err)
+		}
+		if opts.Filter != nil && !opts.Filter(entry.Key) {
+			result.Skipped++
+			continue
+		}
+		digest, err := valueDigest(entry.Value)
+		if err != nil {
+			return result, fmt.Errorf("Error decoding value of %s in dump entry %d: %v", entry.Key, line, err)
+		}
+		chunk[entry.Key] = entry.Value
+		digests[entry.Key] = digest
+		if len(chunk) >= opts.ChunkSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+
+	if mode == ModeReplace {
+		removed, err := removeOthers(client, bucket, digests, opts)
+		result.Removed = removed
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if !opts.SkipVerify {
+		if err := verify(client, bucket, digests); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// removeOthers deletes the selected keys of bucket that aren't in the dump,
+// after it was restored, so that the bucket is never seen empty. Keys are
+// deleted one by one, and keys already deleted meanwhile are ignored.
+func removeOthers(client metadata.Metadata, bucket string, dumped map[string]string, opts RestoreOptions) (int, error) {
+	current, err := listKeys(client, bucket)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	for _, key := range current {
+		if _, ok := dumped[key]; !ok && (opts.Filter == nil || opts.Filter(key)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		removed  int
+		firstErr error
+	)
+	sem := make(chan struct{}, opts.Concurrency)
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			deleted, err := client.Delete(bucket, key)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("Error deleting %s: %v", key, err)
+			} else if deleted {
+				removed++
+			}
+		}(key)
+	}
+	wg.Wait()
+	return removed, firstErr
+}
+
+// verify compares the values of the restored keys with the dump, reading the
+// bucket a page at a time
+func verify(client metadata.Metadata, bucket string, dumped map[string]string) error {
+	var mismatches []string
+	found := map[string]bool{}
+	marker := ""
+	for {
+		list, _, err := client.List(bucket, &metadata.Options{IncludeValue: true, Limit: defaultPageSize, Marker: marker})
+		if err != nil {
+			return err
+		}
+		for _, entry := range list.Data {
+			digest, ok := dumped[entry.Key]
+			if !ok {
+				continue
+			}
+			found[entry.Key] = true
+			if currentDigest, err := valueDigest(entry.Value); err != nil || currentDigest != digest {
+				mismatches = append(mismatches, entry.Key)
+			}
+		}
+		if list.NextMarker == "" || len(list.Data) == 0 {
+			break
+		}
+		marker = list.NextMarker
+	}
+
+	for key := range dumped {
+		if !found[key] {
+			mismatches = append(mismatches, key+" (missing)")
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("Restored keys differ from dump in bucket %s: %s", bucket, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// valueDigest hashes a JSON value re-encoded from its decoded form, so that
+// values differing only in formatting or key order have the same digest
+func valueDigest(value json.RawMessage) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var decoded interface{}
+	if err := dec.Decode(&decoded); err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(decoded)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// listKeys returns the keys of bucket
+func listKeys(client metadata.Metadata, bucket string) ([]string, error) {
+	var keys []string
+	marker := ""
+	for {
+		list, _, err := client.List(bucket, &metadata.Options{Limit: defaultPageSize, Marker: marker})
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list.Data {
+			keys = append(keys, entry.Key)
+		}
+		if list.NextMarker == "" || len(list.Data) == 0 {
+			return keys, nil
+		}
+		marker = list.NextMarker
+	}
+}
@@ -3,14 +3,14 @@ package metadata
 import (
 	"fmt"
 	"net/http"
+	"sort"
 
 	"strconv"
-
 	"sync"
 
-	"strings"
-
 	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/common"
+	"github.com/vtex/go-clients/schema"
 	"gopkg.in/h2non/gentleman.v1"
 )
 
@@ -25,43 +25,79 @@ type Options struct {
 // Metadata is an interface for interacting with Metadata
 type Metadata interface {
 	GetBucket(bucket string) (*BucketResponse, string, error)
-	SetBucketState(bucket, state string) error
+	SetBucketState(bucket string, state common.BucketState) error
 	List(bucket string, options *Options) (*MetadataListResponse, string, error)
 	ListAll(bucket string, includeValue bool) (*MetadataListResponse, string, error)
 	Get(bucket, key string, data interface{}) (string, error)
 	Save(bucket, key string, data interface{}) (string, error)
 	SaveAll(bucket string, data map[string]interface{}) (string, error)
 	DoAll(bucket string, patch MetadataPatchRequest) error
+	DoAllWithOptions(bucket string, patch MetadataPatchRequest, opts DoAllOptions) error
 	Delete(bucket, key string) (bool, error)
 	DeleteAll(bucket string) error
 	ListAllConflicts(bucket string) ([]*MetadataConflict, error)
 	ResolveConflicts(bucket string, patch MetadataPatchRequest) error
 }
 
+// ConditionalDeleter is implemented by Metadata clients able to delete a key
+// only if its hash is still a known one, failing otherwise with a
+// precondition failed error
+type ConditionalDeleter interface {
+	DeleteIfMatch(bucket, key, hash string) (bool, error)
+}
+
+// ConditionalSaver is implemented by Metadata clients able to save a key only
+// if its hash is still a known one, or only if it doesn't exist when hash is
+// empty, failing otherwise with a precondition failed error
+type ConditionalSaver interface {
+	SaveIfMatch(bucket, key string, data interface{}, hash string) (string, error)
+}
+
 type ConflictResolver interface {
 	Resolve(client Metadata, bucketDetected string) (resolved bool, err error)
 }
 
+// ClientOptions configures optional behaviors of a Metadata client
+type ClientOptions struct {
+	// Schemas, if set, validates values written by Save, SaveAll and DoAll,
+	// failing with a *schema.ValidationError before sending invalid ones
+	Schemas *schema.Registry
+	// ValidateReads also validates values read with Get and List, to detect
+	// invalid data saved before the schemas were in place
+	ValidateReads bool
+}
+
 type client struct {
 	http             *gentleman.Client
 	conflictResolver ConflictResolver
 	appName          string
+	schemas          *schema.Registry
+	validateReads    bool
 }
 
 // NewClient creates a Metadata client with specified configuration. Conflict
 // resolver is optional but if set, will be called for each detected conflict in
 // metadata access methods to attempt a resolution logic.
 func NewClient(config *clients.Config, resolver ConflictResolver) (Metadata, error) {
+	return NewClientWithOptions(config, resolver, ClientOptions{})
+}
+
+// NewClientWithOptions creates a Metadata client with optional behaviors
+func NewClientWithOptions(config *clients.Config, resolver ConflictResolver, opts ClientOptions) (Metadata, error) {
 	appName := clients.UserAgentName(config)
 	if appName == "" {
 		return nil, clients.NewNoUserAgentError("User-Agent is missing to create a Metadata client.")
 	}
-	return NewCustomAppClient(appName, config, resolver), nil
+	return NewCustomAppClientWithOptions(appName, config, resolver, opts), nil
 }
 
 func NewCustomAppClient(appName string, config *clients.Config, resolver ConflictResolver) Metadata {
+	return NewCustomAppClientWithOptions(appName, config, resolver, ClientOptions{})
+}
+
+func NewCustomAppClientWithOptions(appName string, config *clients.Config, resolver ConflictResolver, opts ClientOptions) Metadata {
 	cl := clients.CreatePlatformClient(config)
-	return &client{cl, resolver, appName}
+	return &client{cl, resolver, appName, opts.Schemas, opts.ValidateReads}
 }
 
 const (
@@ -87,7 +123,7 @@ func (cl *client) GetBucket(bucket string) (*BucketResponse, string, error) {
 	return &bucketResponse, res.Header.Get(clients.HeaderETag), nil
 }
 
-func (cl *client) SetBucketState(bucket, state string) error {
+func (cl *client) SetBucketState(bucket string, state common.BucketState) error {
 	_, err := cl.http.Put().
 		AddPath(fmt.Sprintf(bucketStatePath, cl.appName, bucket)).
 		JSON(state).Send()
@@ -98,6 +134,10 @@ func (cl *client) SetBucketState(bucket, state string) error {
 }
 
 func (cl *client) List(bucket string, options *Options) (*MetadataListResponse, string, error) {
+	return cl.list(bucket, options, cl.resolver(bucket))
+}
+
+func (cl *client) list(bucket string, options *Options, resolve resolveFunc) (*MetadataListResponse, string, error) {
 	if options.Limit <= 0 {
 		options.Limit = 10
 	}
@@ -109,7 +149,7 @@ func (cl *client) List(bucket string, options *Options) (*MetadataListResponse,
 			"_limit":  strconv.Itoa(options.Limit),
 			"_marker": options.Marker,
 		})
-	res, err := cl.performConflictResolved(bucket, req)
+	res, err := cl.performWithResolver(bucket, req, resolve)
 
 	if err != nil {
 		return nil, "", err
@@ -119,6 +159,13 @@ func (cl *client) List(bucket string, options *Options) (*MetadataListResponse,
 	if err := res.JSON(&metadata); err != nil {
 		return nil, "", err
 	}
+	if cl.validateReads && options.IncludeValue {
+		for _, entry := range metadata.Data {
+			if err := cl.schemas.ValidateJSON(bucket, entry.Key, entry.Value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
 
 	return &metadata, res.Header.Get(clients.HeaderETag), nil
 }
@@ -161,6 +208,11 @@ func (cl *client) Get(bucket, key string, data interface{}) (string, error) {
 		return "", err
 	}
 
+	if cl.validateReads {
+		if err := cl.schemas.ValidateJSON(bucket, key, res.Bytes()); err != nil {
+			return "", err
+		}
+	}
 	if err := res.JSON(data); err != nil {
 		return "", err
 	}
@@ -170,6 +222,9 @@ func (cl *client) Get(bucket, key string, data interface{}) (string, error) {
 
 // Save saves generic data serializing it to JSON
 func (cl *client) Save(bucket, key string, data interface{}) (string, error) {
+	if err := cl.schemas.Validate(bucket, key, data); err != nil {
+		return "", err
+	}
 	req := cl.http.Put().
 		AddPath(fmt.Sprintf(metadataKeyPath, cl.appName, bucket, key)).
 		JSON(data)
@@ -182,7 +237,35 @@ func (cl *client) Save(bucket, key string, data interface{}) (string, error) {
 	return res.Header.Get(clients.HeaderETag), nil
 }
 
+// SaveIfMatch saves a key unless it changed since it had hash, or only if it
+// doesn't exist when hash is empty
+func (cl *client) SaveIfMatch(bucket, key string, data interface{}, hash string) (string, error) {
+	if err := cl.schemas.Validate(bucket, key, data); err != nil {
+		return "", err
+	}
+	req := cl.http.Put().
+		AddPath(fmt.Sprintf(metadataKeyPath, cl.appName, bucket, key)).
+		JSON(data)
+	if hash != "" {
+		req = req.SetHeader("If-Match", hash)
+	} else {
+		req = req.SetHeader("If-None-Match", "*")
+	}
+	res, err := cl.performConflictResolved(bucket, req)
+
+	if err != nil {
+		return "", err
+	}
+
+	return res.Header.Get(clients.HeaderETag), nil
+}
+
 func (cl *client) SaveAll(bucket string, data map[string]interface{}) (string, error) {
+	for _, key := range sortedKeys(data) {
+		if err := cl.schemas.Validate(bucket, key, data[key]); err != nil {
+			return "", err
+		}
+	}
 	req := cl.http.Put().
 		AddPath(fmt.Sprintf(metadataPath, cl.appName, bucket)).
 		JSON(data)
@@ -210,57 +293,29 @@ func (cl *client) Delete(bucket, key string) (bool, error) {
 	return true, nil
 }
 
-func (cl *client) DeleteAll(bucket string) error {
-	_, err := cl.http.Delete().
-		AddPath(fmt.Sprintf(metadataPath, cl.appName, bucket)).
-		Send()
-
-	return err
-}
-
-func (cl *client) DoAll(bucket string, patch MetadataPatchRequest) error {
-	toSave := map[string]interface{}{}
-	// not to block goroutines, assume at most one error per operation
-	errs := make(chan error, len(patch))
-
-	wg := sync.WaitGroup{}
-	for _, op := range patch {
-		switch op.Type {
-		case OperationTypeReplace:
-			toSave[op.Key] = op.Value
-		case OperationTypeRemove:
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				_, err := cl.Delete(bucket, op.Key)
-				if err != nil {
-					errs <- fmt.Errorf("Delete %s: %v", op.Key, err)
-				}
-			}()
-		}
-	}
+// DeleteIfMatch deletes a key unless it changed since it had hash
+func (cl *client) DeleteIfMatch(bucket, key, hash string) (bool, error) {
+	req := cl.http.Delete().
+		AddPath(fmt.Sprintf(metadataKeyPath, cl.appName, bucket, key)).
+		SetHeader("If-Match", hash)
+	_, err := cl.performConflictResolved(bucket, req)
 
-	if len(toSave) > 0 {
-		_, err := cl.SaveAll(bucket, toSave)
-		if err != nil {
-			errs <- fmt.Errorf("Save keys %v: %v", mapKeys(toSave), err)
+	if err != nil {
+		if clients.IsNotFound(err) {
+			return false, nil
 		}
+		return false, err
 	}
 
-	wg.Wait()
-	close(errs)
-
-	errCount := len(errs)
-	if errCount > 0 {
-		errMsgs := make([]string, 0, errCount)
-		for err := range errs {
-			errMsgs = append(errMsgs, err.Error())
-		}
+	return true, nil
+}
 
-		return fmt.Errorf("Error(s) in metadata patch in bucket %s: %s", bucket, strings.Join(errMsgs, "; "))
-	}
+func (cl *client) DeleteAll(bucket string) error {
+	_, err := cl.http.Delete().
+		AddPath(fmt.Sprintf(metadataPath, cl.appName, bucket)).
+		Send()
 
-	return nil
+	return err
 }
 
 func (cl *client) ListAllConflicts(bucket string) ([]*MetadataConflict, error) {
@@ -288,7 +343,44 @@ func (cl *client) ResolveConflicts(bucket string, patch MetadataPatchRequest) er
 }
 
 func (cl *client) performConflictResolved(bucket string, req *gentleman.Request) (*gentleman.Response, error) {
+	return cl.performWithResolver(bucket, req, cl.resolver(bucket))
+}
+
+// resolveFunc attempts to resolve the conflicts of a bucket
+type resolveFunc func() (resolved bool, err error)
+
+// resolver returns the resolveFunc calling the client's conflict resolver, or
+// nil if it has none
+func (cl *client) resolver(bucket string) resolveFunc {
 	if cl.conflictResolver == nil {
+		return nil
+	}
+	return func() (bool, error) {
+		return cl.conflictResolver.Resolve(cl, bucket)
+	}
+}
+
+// resolveOnce wraps resolve so that it runs at most once, sharing its result
+// among concurrent requests to a same bucket
+func resolveOnce(resolve resolveFunc) resolveFunc {
+	if resolve == nil {
+		return nil
+	}
+	var (
+		once     sync.Once
+		resolved bool
+		err      error
+	)
+	return func() (bool, error) {
+		once.Do(func() {
+			resolved, err = resolve()
+		})
+		return resolved, err
+	}
+}
+
+func (cl *client) performWithResolver(bucket string, req *gentleman.Request, resolve resolveFunc) (*gentleman.Response, error) {
+	if resolve == nil {
 		return req.Send()
 	}
 	req.SetHeader(detectConflictsHeader, "true")
@@ -296,7 +388,7 @@ func (cl *client) performConflictResolved(bucket string, req *gentleman.Request)
 	// Clone request before sending or we won't be able to retry.
 	res, err := req.Clone().Send()
 	if isConflict(err) {
-		resolved, resolveErr := cl.conflictResolver.Resolve(cl, bucket)
+		resolved, resolveErr := resolve()
 		if resolveErr != nil {
 			return nil, fmt.Errorf("Error resolving conflicts: %v", resolveErr)
 		} else if !resolved {
@@ -327,3 +419,9 @@ func mapKeys(m map[string]interface{}) []string {
 	}
 	return keys
 }
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := mapKeys(m)
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,274 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vtex/go-clients/clients"
+)
+
+// DoAllOptions configures how a patch is applied
+type DoAllOptions struct {
+	// Concurrency is the maximum number of simultaneous requests. Defaults
+	// to 4.
+	Concurrency int
+	// Rollback restores the keys touched by the patch to their previous
+	// values if any operation fails, so that the patch is all-or-nothing.
+	// Writes made by other clients to the same keys while the patch is applied
+	// may be overwritten by the rollback.
+	Rollback bool
+	// Strict applies JSON Patch semantics: replace and remove fail with a not
+	// found error when their key doesn't exist, and the patch isn't applied.
+	// Otherwise, replace saves keys whether they exist or not and remove
+	// ignores missing keys.
+	Strict bool
+}
+
+// PatchOpError is the failure of a single patch operation
+type PatchOpError struct {
+	Index int
+	Op    *PatchOperation
+	Err   error
+}
+
+func (e *PatchOpError) Error() string {
+	return fmt.Sprintf("%s %s (operation %d): %v", e.Op.Type, e.Op.Key, e.Index, e.Err)
+}
+
+// PatchError is returned by DoAll when some operations of a patch failed.
+// Patches failing validation, e.g. replacing a key that doesn't exist in
+// strict mode, are not applied at all.
+type PatchError struct {
+	Bucket string
+	Failed []*PatchOpError
+	// Applied tells whether the other operations were applied
+	Applied bool
+	// RolledBack tells whether the applied operations were undone, in which
+	// case RollbackErr is nil
+	RolledBack  bool
+	RollbackErr error
+}
+
+func (e *PatchError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, opErr := range e.Failed {
+		msgs[i] = opErr.Error()
+	}
+	msg := fmt.Sprintf("Error(s) in metadata patch in bucket %s: %s", e.Bucket, strings.Join(msgs, "; "))
+	if e.RollbackErr != nil {
+		msg += fmt.Sprintf(" (rollback failed: %v)", e.RollbackErr)
+	}
+	return msg
+}
+
+// preImage is the value of a key before a patch
+type preImage struct {
+	value  json.RawMessage
+	exists bool
+}
+
+// DoAll applies a patch with the default options
+func (cl *client) DoAll(bucket string, patch MetadataPatchRequest) error {
+	return cl.DoAllWithOptions(bucket, patch, DoAllOptions{})
+}
+
+// DoAllWithOptions applies a patch: add and replace set a key and remove
+// deletes it. Operations on a same key are applied in order. Previous values
+// are only read in strict mode or when rolling back.
+func (cl *client) DoAllWithOptions(bucket string, patch MetadataPatchRequest, opts DoAllOptions) error {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+
+	patchErr := &PatchError{Bucket: bucket}
+	for i, op := range patch {
+		switch op.Type {
+		case OperationTypeAdd, OperationTypeReplace:
+			if err := cl.schemas.Validate(bucket, op.Key, op.Value); err != nil {
+				patchErr.Failed = append(patchErr.Failed, &PatchOpError{i, op, err})
+			}
+		case OperationTypeRemove:
+		default:
+			patchErr.Failed = append(patchErr.Failed, &PatchOpError{i, op, fmt.Errorf("Invalid operation type %q", op.Type)})
+		}
+	}
+	if len(patchErr.Failed) > 0 {
+		return patchErr
+	}
+
+	images, err := cl.preImages(bucket, patch, opts)
+	if err != nil {
+		return err
+	}
+
+	// Replays the patch over the known state of each key, to check the
+	// preconditions and find the final value of each key
+	final := map[string]*preImage{}
+	lastOp := map[string]int{}
+	for i, op := range patch {
+		state, ok := final[op.Key]
+		if !ok {
+			state = images[op.Key]
+		}
+		if opts.Strict && op.Type != OperationTypeAdd && (state == nil || !state.exists) {
+			patchErr.Failed = append(patchErr.Failed, &PatchOpError{i, op, clients.ResponseError{
+				StatusCode: http.StatusNotFound,
+				Code:       "NotFound",
+				Message:    "Key " + op.Key + " doesn't exist",
+			}})
+			continue
+		}
+		final[op.Key] = &preImage{exists: op.Type != OperationTypeRemove}
+		if op.Type != OperationTypeRemove {
+			value, err := json.Marshal(op.Value)
+			if err != nil {
+				patchErr.Failed = append(patchErr.Failed, &PatchOpError{i, op, err})
+				continue
+			}
+			final[op.Key].value = value
+		}
+		lastOp[op.Key] = i
+	}
+	if len(patchErr.Failed) > 0 {
+		return patchErr
+	}
+
+	patchErr.Applied = true
+	failedKeys := cl.applyFinal(bucket, final, opts)
+	if len(failedKeys) == 0 {
+		return nil
+	}
+	for key, err := range failedKeys {
+		i := lastOp[key]
+		patchErr.Failed = append(patchErr.Failed, &PatchOpError{i, patch[i], err})
+	}
+	sortOpErrors(patchErr.Failed)
+
+	if opts.Rollback {
+		restore := map[string]*preImage{}
+		for key := range final {
+			restore[key] = images[key]
+		}
+		if failed := cl.applyFinal(bucket, restore, opts); len(failed) > 0 {
+			patchErr.RollbackErr = fmt.Errorf("Error restoring keys %v", errorKeys(failed))
+		} else {
+			patchErr.RolledBack = true
+		}
+	}
+	return patchErr
+}
+
+// preImages reads the keys whose previous value is needed: every key when
+// rolling back, the ones the patch replaces or removes in strict mode and
+// none otherwise
+func (cl *client) preImages(bucket string, patch MetadataPatchRequest, opts DoAllOptions) (map[string]*preImage, error) {
+	var keys []string
+	seen := map[string]bool{}
+	for _, op := range patch {
+		if !seen[op.Key] && (opts.Rollback || (opts.Strict && op.Type != OperationTypeAdd)) {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+
+	var mu sync.Mutex
+	images := map[string]*preImage{}
+	var firstErr error
+	forEachKey(keys, opts.Concurrency, func(key string) {
+		var raw json.RawMessage
+		_, err := cl.Get(bucket, key, &raw)
+		image := &preImage{value: raw, exists: err == nil}
+		if err != nil && !clients.IsNotFound(err) {
+			image = nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if image == nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Error reading %s before patch: %v", key, err)
+			}
+			return
+		}
+		images[key] = image
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	// Keys not read are neither checked nor restored
+	for _, op := range patch {
+		if _, ok := images[op.Key]; !ok {
+			images[op.Key] = &preImage{}
+		}
+	}
+	return images, nil
+}
+
+// applyFinal saves every key with a value in a single request and deletes the
+// others concurrently, returning the errors by key
+func (cl *client) applyFinal(bucket string, final map[string]*preImage, opts DoAllOptions) map[string]error {
+	toSave := map[string]interface{}{}
+	var toDelete []string
+	for key, state := range final {
+		if state.exists {
+			toSave[key] = state.value
+		} else {
+			toDelete = append(toDelete, key)
+		}
+	}
+
+	var mu sync.Mutex
+	failed := map[string]error{}
+	if len(toSave) > 0 {
+		if _, err := cl.SaveAll(bucket, toSave); err != nil {
+			for key := range toSave {
+				failed[key] = err
+			}
+		}
+	}
+	forEachKey(toDelete, opts.Concurrency, func(key string) {
+		// Deleting a key already missing is fine, since it was checked before
+		if _, err := cl.Delete(bucket, key); err != nil {
+			mu.Lock()
+			failed[key] = err
+			mu.Unlock()
+		}
+	})
+	return failed
+}
+
+// forEachKey calls fn with each key, running at most concurrency calls at once
+func forEachKey(keys []string, concurrency int, fn func(key string)) {
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(key)
+		}(key)
+	}
+	wg.Wait()
+}
+
+func sortOpErrors(errs []*PatchOpError) {
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+}
+
+func errorKeys(errs map[string]error) []string {
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
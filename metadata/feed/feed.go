@@ -0,0 +1,465 @@
+// Package feed delivers the changes of a Metadata bucket, with the old and new
+// values of each key, to registered handlers. Changes are detected by polling
+// the bucket hash and diffing the key hashes, so changes made between two
+// polls are coalesced.
+package feed
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/internal/fsutil"
+	"github.com/vtex/go-clients/metadata"
+	"github.com/vtex/go-clients/watch"
+)
+
+const pageSize = 100
+
+// Change is a change to a single key. OldValue is nil for added keys and
+// NewValue is nil for deleted ones.
+type Change struct {
+	Type     watch.EventType
+	Key      string
+	Hash     string
+	OldValue json.RawMessage
+	NewValue json.RawMessage
+}
+
+// Handler is called with each change. When it fails, the change is delivered
+// again on the next poll.
+type Handler func(change *Change) error
+
+// Checkpoint is the state of the bucket as of the last delivered change. It
+// only holds hashes, the delivered values are stored per key.
+type Checkpoint struct {
+	BucketHash string            `json:"bucketHash"`
+	Hashes     map[string]string `json:"hashes"`
+}
+
+// CheckpointStore persists the state of a feed: its checkpoint, and the last
+// value delivered for each key, which becomes the old value of its next
+// change. Load returns nil when there is no checkpoint yet, and LoadValue
+// returns nil for keys without a value.
+type CheckpointStore interface {
+	Load() (*Checkpoint, error)
+	Save(checkpoint *Checkpoint) error
+	LoadValue(key string) (json.RawMessage, error)
+	SaveValue(key string, value json.RawMessage) error
+	DeleteValue(key string) error
+}
+
+// Options configures a Feed
+type Options struct {
+	// Checkpoints persists the feed state, so that a restarted feed only
+	// delivers the changes made since. Defaults to keeping it in memory.
+	Checkpoints CheckpointStore
+	// EmitInitial delivers every key as added when there is no checkpoint.
+	// Otherwise, the first poll only records the state of the bucket.
+	EmitInitial bool
+	// MaxBackoff bounds the wait between polls after consecutive errors.
+	// Defaults to five minutes.
+	MaxBackoff time.Duration
+	// OnError, if set, is called with every polling and handler error
+	OnError func(err error)
+}
+
+// Feed polls a bucket and delivers its changes, ordered by key within each
+// poll, to its handlers
+type Feed struct {
+	client metadata.Metadata
+	bucket string
+	opts   Options
+
+	// pollMu serializes polls, while mu guards the fields below it and isn't
+	// held while handlers run
+	pollMu     sync.Mutex
+	mu         sync.Mutex
+	handlers   []Handler
+	checkpoint *Checkpoint
+	loaded     bool
+}
+
+// NewFeed creates a Feed of the changes in bucket
+func NewFeed(client metadata.Metadata, bucket string, opts Options) *Feed {
+	if opts.Checkpoints == nil {
+		opts.Checkpoints = &memoryCheckpoints{values: map[string]json.RawMessage{}}
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	return &Feed{client: client, bucket: bucket, opts: opts}
+}
+
+// Subscribe registers a handler. Handlers are called in the order they were
+// registered, and a change is only delivered to the next handlers after the
+// previous ones succeed.
+func (f *Feed) Subscribe(h Handler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers = append(f.handlers, h)
+}
+
+// Run polls the bucket every interval until ctx is done
+func (f *Feed) Run(ctx context.Context, interval time.Duration) error {
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		if _, err := f.Poll(); err != nil {
+			if f.opts.OnError != nil {
+				f.opts.OnError(err)
+			}
+			wait = watch.Backoff(wait, interval, f.opts.MaxBackoff)
+			continue
+		}
+		wait = interval
+	}
+}
+
+// Poll checks the bucket once, delivering its changes since the checkpoint,
+// and returns the number of changes delivered. The checkpoint is saved after
+// the changes are delivered, including when a handler fails midway.
+func (f *Feed) Poll() (int, error) {
+	f.pollMu.Lock()
+	defer f.pollMu.Unlock()
+
+	last, err := f.loadCheckpoint()
+	if err != nil {
+		return 0, err
+	}
+
+	bucket, _, err := f.client.GetBucket(f.bucket)
+	if err != nil {
+		return 0, err
+	}
+	if last != nil && last.BucketHash == bucket.Hash {
+		return 0, nil
+	}
+
+	if last == nil && !f.opts.EmitInitial {
+		checkpoint, err := f.snapshot(bucket.Hash)
+		if err != nil {
+			return 0, err
+		}
+		return 0, f.saveCheckpoint(checkpoint)
+	}
+
+	hashes, err := f.listHashes()
+	if err != nil {
+		return 0, err
+	}
+
+	next := &Checkpoint{Hashes: map[string]string{}}
+	oldHashes := map[string]string{}
+	if last != nil {
+		for key, hash := range last.Hashes {
+			next.Hashes[key] = hash
+			oldHashes[key] = hash
+		}
+	}
+
+	delivered := 0
+	for _, event := range watch.Diff(oldHashes, hashes) {
+		err := f.apply(event, next)
+		if err == errNoChange {
+			continue
+		} else if err != nil {
+			// Keeps the previous bucket hash so that the next poll diffs again
+			if last != nil {
+				next.BucketHash = last.BucketHash
+			}
+			if saveErr := f.saveCheckpoint(next); saveErr != nil {
+				return delivered, saveErr
+			}
+			return delivered, err
+		}
+		delivered++
+	}
+
+	next.BucketHash = bucket.Hash
+	return delivered, f.saveCheckpoint(next)
+}
+
+// errNoChange is returned by apply for keys added and deleted between two
+// polls
+var errNoChange = errors.New("No change")
+
+// apply delivers the change of a key, then records its new value and hash
+func (f *Feed) apply(event watch.Event, next *Checkpoint) error {
+	change := &Change{Type: event.Type, Key: event.Key, Hash: event.Hash}
+	if event.Type != watch.Added {
+		old, err := f.opts.Checkpoints.LoadValue(event.Key)
+		if err != nil {
+			return errors.Wrapf(err, "Error loading checkpoint value of %s", event.Key)
+		}
+		change.OldValue = old
+	}
+
+	if event.Type != watch.Deleted {
+		var value json.RawMessage
+		if _, err := f.client.Get(f.bucket, event.Key, &value); clients.IsNotFound(err) {
+			if event.Type == watch.Added {
+				delete(next.Hashes, event.Key)
+				return errNoChange
+			}
+			change.Type = watch.Deleted
+			change.Hash = ""
+		} else if err != nil {
+			return err
+		} else {
+			// The listed hash is kept even if the value changed since, in
+			// which case the next poll delivers the change again
+			change.NewValue = value
+		}
+	}
+
+	if err := f.deliver(change); err != nil {
+		return err
+	}
+
+	if change.Type == watch.Deleted {
+		delete(next.Hashes, event.Key)
+		if err := f.opts.Checkpoints.DeleteValue(event.Key); err != nil {
+			return errors.Wrap(err, "Error deleting checkpoint value")
+		}
+		return nil
+	}
+	next.Hashes[event.Key] = event.Hash
+	if err := f.opts.Checkpoints.SaveValue(event.Key, change.NewValue); err != nil {
+		return errors.Wrap(err, "Error saving checkpoint value")
+	}
+	return nil
+}
+
+func (f *Feed) loadCheckpoint() (*Checkpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.loaded {
+		checkpoint, err := f.opts.Checkpoints.Load()
+		if err != nil {
+			return nil, errors.Wrap(err, "Error loading feed checkpoint")
+		}
+		f.checkpoint = checkpoint
+		f.loaded = true
+	}
+	return f.checkpoint, nil
+}
+
+func (f *Feed) saveCheckpoint(checkpoint *Checkpoint) error {
+	if err := f.opts.Checkpoints.Save(checkpoint); err != nil {
+		return errors.Wrap(err, "Error saving feed checkpoint")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checkpoint = checkpoint
+	return nil
+}
+
+// deliver calls the handlers without holding the lock, so that slow handlers
+// don't block Subscribe
+func (f *Feed) deliver(change *Change) error {
+	f.mu.Lock()
+	handlers := append([]Handler(nil), f.handlers...)
+	f.mu.Unlock()
+
+	for _, h := range handlers {
+		if err := h(change); err != nil {
+			return errors.Wrapf(err, "Error handling change of %s", change.Key)
+		}
+	}
+	return nil
+}
+
+// snapshot records the initial state of the bucket, saving the value of
+// every key
+func (f *Feed) snapshot(bucketHash string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{BucketHash: bucketHash, Hashes: map[string]string{}}
+	marker := ""
+	for {
+		list, _, err := f.client.List(f.bucket, &metadata.Options{IncludeValue: true, Limit: pageSize, Marker: marker})
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list.Data {
+			if err := f.opts.Checkpoints.SaveValue(entry.Key, entry.Value); err != nil {
+				return nil, errors.Wrap(err, "Error saving checkpoint value")
+			}
+			checkpoint.Hashes[entry.Key] = entry.Hash
+		}
+		if list.NextMarker == "" || len(list.Data) == 0 {
+			return checkpoint, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+func (f *Feed) listHashes() (map[string]string, error) {
+	hashes := map[string]string{}
+	marker := ""
+	for {
+		list, _, err := f.client.List(f.bucket, &metadata.Options{Limit: pageSize, Marker: marker})
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list.Data {
+			hashes[entry.Key] = entry.Hash
+		}
+		if list.NextMarker == "" || len(list.Data) == 0 {
+			return hashes, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+type memoryCheckpoints struct {
+	mu         sync.Mutex
+	checkpoint *Checkpoint
+	values     map[string]json.RawMessage
+}
+
+func (m *memoryCheckpoints) Load() (*Checkpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoint, nil
+}
+
+func (m *memoryCheckpoints) Save(checkpoint *Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoint = checkpoint
+	return nil
+}
+
+func (m *memoryCheckpoints) LoadValue(key string) (json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key], nil
+}
+
+func (m *memoryCheckpoints) SaveValue(key string, value json.RawMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+	return nil
+}
+
+func (m *memoryCheckpoints) DeleteValue(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+// MetadataCheckpoints stores checkpoints as a key of a Metadata bucket, which
+// must not be the bucket of the feed. The value of each key of the feed is
+// stored in its own key, prefixed by Key.
+type MetadataCheckpoints struct {
+	Client metadata.Metadata
+	Bucket string
+	Key    string
+}
+
+func (m *MetadataCheckpoints) Load() (*Checkpoint, error) {
+	var checkpoint Checkpoint
+	if _, err := m.Client.Get(m.Bucket, m.Key, &checkpoint); clients.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (m *MetadataCheckpoints) Save(checkpoint *Checkpoint) error {
+	_, err := m.Client.Save(m.Bucket, m.Key, checkpoint)
+	return err
+}
+
+func (m *MetadataCheckpoints) LoadValue(key string) (json.RawMessage, error) {
+	var value json.RawMessage
+	if _, err := m.Client.Get(m.Bucket, m.valueKey(key), &value); clients.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (m *MetadataCheckpoints) SaveValue(key string, value json.RawMessage) error {
+	_, err := m.Client.Save(m.Bucket, m.valueKey(key), value)
+	return err
+}
+
+func (m *MetadataCheckpoints) DeleteValue(key string) error {
+	_, err := m.Client.Delete(m.Bucket, m.valueKey(key))
+	return err
+}
+
+// valueKey hex encodes key, so that any key of the feed is a valid key
+func (m *MetadataCheckpoints) valueKey(key string) string {
+	return m.Key + "-" + hex.EncodeToString([]byte(key))
+}
+
+// FileCheckpoints stores checkpoints in a local JSON file, and the value of
+// each key of the feed in a file of the directory named after it with a
+// ".values" suffix
+type FileCheckpoints struct {
+	Path string
+}
+
+func (c *FileCheckpoints) Load() (*Checkpoint, error) {
+	content, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(content, &checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (c *FileCheckpoints) Save(checkpoint *Checkpoint) error {
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(c.Path, content)
+}
+
+func (c *FileCheckpoints) LoadValue(key string) (json.RawMessage, error) {
+	content, err := ioutil.ReadFile(c.valuePath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (c *FileCheckpoints) SaveValue(key string, value json.RawMessage) error {
+	return fsutil.WriteFileAtomic(c.valuePath(key), value)
+}
+
+func (c *FileCheckpoints) DeleteValue(key string) error {
+	err := os.Remove(c.valuePath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *FileCheckpoints) valuePath(key string) string {
+	return filepath.Join(c.Path+".values", hex.EncodeToString([]byte(key)))
+}
@@ -0,0 +1,434 @@
+// Package fsbackend implements metadata.Metadata on top of a local directory,
+// to run services offline. Each key is stored as a JSON file under
+// root/account/workspace/app/bucket. Buckets are locked with file locks, so
+// that several processes may share a directory.
+package fsbackend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/common"
+	"github.com/vtex/go-clients/internal/fsutil"
+	"github.com/vtex/go-clients/metadata"
+)
+
+const keySuffix = ".json"
+
+type backend struct {
+	appDir string
+}
+
+// New creates a Metadata client storing keys under root, for the account,
+// workspace and app in config
+func New(root string, config *clients.Config) (metadata.Metadata, error) {
+	appName := clients.UserAgentName(config)
+	if appName == "" {
+		return nil, clients.NewNoUserAgentError("User-Agent is missing to create a Metadata client.")
+	}
+	return NewCustomApp(root, appName, config), nil
+}
+
+// NewCustomApp creates a Metadata client storing keys under root, for appName
+// and the account and workspace in config
+func NewCustomApp(root, appName string, config *clients.Config) metadata.Metadata {
+	return &backend{filepath.Join(root, config.Account, config.Workspace, appName)}
+}
+
+func (b *backend) bucketDir(bucket string) (string, error) {
+	if err := fsutil.CheckName(bucket); err != nil {
+		return "", err
+	}
+	return filepath.Join(b.appDir, bucket), nil
+}
+
+// keyFile returns the name of the file storing key. Keys are escaped so that
+// they are flat and never clash with the backend's own dot files.
+func keyFile(key string) string {
+	name := url.PathEscape(key)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name + keySuffix
+}
+
+func fileKey(name string) (string, bool) {
+	if !strings.HasSuffix(name, keySuffix) || strings.HasPrefix(name, ".") {
+		return "", false
+	}
+	key, err := url.PathUnescape(strings.TrimSuffix(name, keySuffix))
+	return key, err == nil
+}
+
+func (b *backend) withLock(bucket string, exclusive bool, fn func(dir string) error) error {
+	dir, err := b.bucketDir(bucket)
+	if err != nil {
+		return err
+	}
+	unlock, err := fsutil.LockBucket(dir, exclusive)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn(dir)
+}
+
+func (b *backend) GetBucket(bucket string) (*metadata.BucketResponse, string, error) {
+	var info *fsutil.Bucket
+	err := b.withLock(bucket, false, func(dir string) error {
+		var err error
+		info, err = fsutil.ReadBucket(dir)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &metadata.BucketResponse{Hash: info.Hash}, info.Hash, nil
+}
+
+func (b *backend) SetBucketState(bucket string, state common.BucketState) error {
+	return b.withLock(bucket, true, func(dir string) error {
+		info, err := fsutil.ReadBucket(dir)
+		if err != nil {
+			return err
+		}
+		info.State = state
+		return fsutil.WriteBucket(dir, info)
+	})
+}
+
+func (b *backend) List(bucket string, options *metadata.Options) (*metadata.MetadataListResponse, string, error) {
+	if options.Limit <= 0 {
+		options.Limit = 10
+	}
+
+	list := &metadata.MetadataListResponse{}
+	var hash string
+	err := b.withLock(bucket, false, func(dir string) error {
+		keys, err := listKeys(dir)
+		if err != nil {
+			return err
+		}
+
+		var selected []string
+		for _, key := range keys {
+			if key >= options.Marker {
+				selected = append(selected, key)
+			}
+		}
+		if len(selected) > options.Limit {
+			list.NextMarker = selected[options.Limit]
+			selected = selected[:options.Limit]
+		}
+
+		for _, key := range selected {
+			value, err := ioutil.ReadFile(filepath.Join(dir, keyFile(key)))
+			if err != nil {
+				return err
+			}
+			entry := &metadata.MetadataResponseEntry{Key: key, Hash: fsutil.ContentHash(value)}
+			if options.IncludeValue {
+				entry.Value = value
+			}
+			list.Data = append(list.Data, entry)
+		}
+
+		info, err := fsutil.ReadBucket(dir)
+		if err != nil {
+			return err
+		}
+		hash = info.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return list, hash, nil
+}
+
+func (b *backend) ListAll(bucket string, includeValue bool) (*metadata.MetadataListResponse, string, error) {
+	return b.List(bucket, &metadata.Options{IncludeValue: includeValue, Limit: math.MaxInt32})
+}
+
+func listKeys(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, info := range infos {
+		if key, ok := fileKey(info.Name()); ok && !info.IsDir() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b *backend) Get(bucket, key string, data interface{}) (string, error) {
+	var value []byte
+	err := b.withLock(bucket, false, func(dir string) error {
+		var err error
+		value, err = ioutil.ReadFile(filepath.Join(dir, keyFile(key)))
+		if os.IsNotExist(err) {
+			return fsutil.NotFound("Key not found: " + key)
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(value, data); err != nil {
+		return "", err
+	}
+	return fsutil.ContentHash(value), nil
+}
+
+// GetMany reads every key while holding the bucket lock, so the values are
+// consistent with each other
+func (b *backend) GetMany(bucket string, keys []string, opts metadata.GetManyOptions) (*metadata.GetManyResponse, error) {
+	res := &metadata.GetManyResponse{Values: map[string]json.RawMessage{}, ETags: map[string]string{}}
+	err := b.withLock(bucket, false, func(dir string) error {
+		missing := map[string]bool{}
+		for _, key := range keys {
+			if _, ok := res.Values[key]; ok || missing[key] {
+				continue
+			}
+			value, err := ioutil.ReadFile(filepath.Join(dir, keyFile(key)))
+			if os.IsNotExist(err) {
+				missing[key] = true
+				res.NotFound = append(res.NotFound, key)
+				continue
+			} else if err != nil {
+				return err
+			}
+			res.Values[key] = value
+			res.ETags[key] = fsutil.ContentHash(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(res.NotFound)
+	return res, nil
+}
+
+func (b *backend) Save(bucket, key string, data interface{}) (string, error) {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	err = b.withLock(bucket, true, func(dir string) error {
+		if err := fsutil.WriteFileAtomic(filepath.Join(dir, keyFile(key)), value); err != nil {
+			return err
+		}
+		return fsutil.TouchBucket(dir)
+	})
+	if err != nil {
+		return "", err
+	}
+	return fsutil.ContentHash(value), nil
+}
+
+func (b *backend) SaveIfMatch(bucket, key string, data interface{}, hash string) (string, error) {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	err = b.withLock(bucket, true, func(dir string) error {
+		keyPath := filepath.Join(dir, keyFile(key))
+		current, err := ioutil.ReadFile(keyPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		exists := err == nil
+		if (hash == "" && exists) || (hash != "" && (!exists || fsutil.ContentHash(current) != hash)) {
+			return clients.ResponseError{StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed"}
+		}
+		if err := fsutil.WriteFileAtomic(keyPath, value); err != nil {
+			return err
+		}
+		return fsutil.TouchBucket(dir)
+	})
+	if err != nil {
+		return "", err
+	}
+	return fsutil.ContentHash(value), nil
+}
+
+func (b *backend) SaveAll(bucket string, data map[string]interface{}) (string, error) {
+	patch := make(metadata.MetadataPatchRequest, 0, len(data))
+	for key, value := range data {
+		patch = append(patch, &metadata.PatchOperation{Type: metadata.OperationTypeReplace, Key: key, Value: value})
+	}
+	if err := b.DoAll(bucket, patch); err != nil {
+		return "", err
+	}
+	_, hash, err := b.GetBucket(bucket)
+	return hash, err
+}
+
+func (b *backend) DoAll(bucket string, patch metadata.MetadataPatchRequest) error {
+	return b.DoAllWithOptions(bucket, patch, metadata.DoAllOptions{})
+}
+
+// DoAllWithOptions applies the patch while holding the bucket lock, so that
+// other processes don't see it half applied. If writing a key fails, the keys
+// already written are restored when opts.Rollback is set. Concurrency is
+// ignored.
+func (b *backend) DoAllWithOptions(bucket string, patch metadata.MetadataPatchRequest, opts metadata.DoAllOptions) error {
+	patchErr := &metadata.PatchError{Bucket: bucket}
+	values := make([][]byte, len(patch))
+	for i, op := range patch {
+		var err error
+		switch op.Type {
+		case metadata.OperationTypeAdd, metadata.OperationTypeReplace:
+			values[i], err = json.Marshal(op.Value)
+		case metadata.OperationTypeRemove:
+		default:
+			err = fsutil.BadRequest("Invalid operation " + string(op.Type))
+		}
+		if err != nil {
+			patchErr.Failed = append(patchErr.Failed, &metadata.PatchOpError{Index: i, Op: op, Err: err})
+		}
+	}
+	if len(patchErr.Failed) > 0 {
+		return patchErr
+	}
+
+	return b.withLock(bucket, true, func(dir string) error {
+		images := map[string][]byte{}
+		exists := map[string]bool{}
+		for i, op := range patch {
+			if _, ok := exists[op.Key]; !ok {
+				value, err := ioutil.ReadFile(filepath.Join(dir, keyFile(op.Key)))
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				images[op.Key] = value
+				exists[op.Key] = err == nil
+			}
+			if opts.Strict && op.Type != metadata.OperationTypeAdd && !exists[op.Key] {
+				patchErr.Failed = append(patchErr.Failed, &metadata.PatchOpError{Index: i, Op: op, Err: fsutil.NotFound("Key " + op.Key + " doesn't exist")})
+				continue
+			}
+			exists[op.Key] = op.Type != metadata.OperationTypeRemove
+		}
+		if len(patchErr.Failed) > 0 {
+			return patchErr
+		}
+
+		patchErr.Applied = true
+		for i, op := range patch {
+			keyPath := filepath.Join(dir, keyFile(op.Key))
+			var err error
+			if op.Type == metadata.OperationTypeRemove {
+				if err = os.Remove(keyPath); os.IsNotExist(err) {
+					err = nil
+				}
+			} else {
+				err = fsutil.WriteFileAtomic(keyPath, values[i])
+			}
+			if err != nil {
+				patchErr.Failed = append(patchErr.Failed, &metadata.PatchOpError{Index: i, Op: op, Err: err})
+				if opts.Rollback {
+					patchErr.RollbackErr = restoreKeys(dir, images)
+					patchErr.RolledBack = patchErr.RollbackErr == nil
+				}
+				// Some keys may have changed even when rolled back
+				fsutil.TouchBucket(dir)
+				return patchErr
+			}
+		}
+		return fsutil.TouchBucket(dir)
+	})
+}
+
+// restoreKeys writes back the values keys had before a patch, removing the
+// ones that didn't exist
+func restoreKeys(dir string, images map[string][]byte) error {
+	for key, value := range images {
+		keyPath := filepath.Join(dir, keyFile(key))
+		if value == nil {
+			if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else if err := fsutil.WriteFileAtomic(keyPath, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backend) Delete(bucket, key string) (bool, error) {
+	deleted := false
+	err := b.withLock(bucket, true, func(dir string) error {
+		err := os.Remove(filepath.Join(dir, keyFile(key)))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		deleted = true
+		return fsutil.TouchBucket(dir)
+	})
+	return deleted, err
+}
+
+func (b *backend) DeleteIfMatch(bucket, key, hash string) (bool, error) {
+	deleted := false
+	err := b.withLock(bucket, true, func(dir string) error {
+		keyPath := filepath.Join(dir, keyFile(key))
+		value, err := ioutil.ReadFile(keyPath)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fsutil.ContentHash(value) != hash {
+			return clients.ResponseError{StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed"}
+		}
+		if err := os.Remove(keyPath); err != nil {
+			return err
+		}
+		deleted = true
+		return fsutil.TouchBucket(dir)
+	})
+	return deleted, err
+}
+
+func (b *backend) DeleteAll(bucket string) error {
+	return b.withLock(bucket, true, func(dir string) error {
+		keys, err := listKeys(dir)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := os.Remove(filepath.Join(dir, keyFile(key))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return fsutil.TouchBucket(dir)
+	})
+}
+
+// ListAllConflicts returns no conflicts, since a local directory has no
+// workspace merges
+func (b *backend) ListAllConflicts(bucket string) ([]*metadata.MetadataConflict, error) {
+	return nil, nil
+}
+
+func (b *backend) ResolveConflicts(bucket string, patch metadata.MetadataPatchRequest) error {
+	return nil
+}
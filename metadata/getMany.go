@@ -0,0 +1,215 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vtex/go-clients/clients"
+)
+
+// minListKeys is the number of keys from which GetMany tries a listing
+const minListKeys = 20
+
+// GetManyOptions configures GetMany
+type GetManyOptions struct {
+	// Concurrency is the maximum number of simultaneous requests. Defaults
+	// to 8.
+	Concurrency int
+	// ListRatio, if positive, makes GetMany list up to ListRatio times as
+	// many keys as requested, with values, in a single request, instead of
+	// reading keys one by one. When the listing has the whole bucket, keys
+	// missing from it are known not to exist. Only set it when the keys
+	// requested are a large part of the bucket, since the listing is wasted
+	// otherwise. Keys are read one by one if the listing fails.
+	ListRatio int
+}
+
+// BatchGetter is implemented by Metadata clients able to read many keys at
+// once. The GetMany function falls back to reading keys one by one with Get
+// for other clients.
+type BatchGetter interface {
+	GetMany(bucket string, keys []string, opts GetManyOptions) (*GetManyResponse, error)
+}
+
+// GetManyResponse holds the values read by GetMany, by key. Keys that don't
+// exist are listed in NotFound, sorted, and are not errors. ETags holds the
+// ETags of the keys read one by one, as returned by Get, so keys read from a
+// listing have none.
+type GetManyResponse struct {
+	Values   map[string]json.RawMessage
+	ETags    map[string]string
+	NotFound []string
+}
+
+// BatchError reports the keys that failed in a batch operation
+type BatchError struct {
+	Bucket string
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	keys := errorKeys(e.Errors)
+	msgs := make([]string, len(keys))
+	for i, key := range keys {
+		msgs[i] = fmt.Sprintf("%s: %v", key, e.Errors[key])
+	}
+	return fmt.Sprintf("Error(s) in %d keys of bucket %s: %s", len(keys), e.Bucket, strings.Join(msgs, "; "))
+}
+
+// GetMany reads the values of keys concurrently. Conflicts are resolved at
+// most once for the whole batch. Keys that failed are reported in a
+// *BatchError, along with the response holding the other keys.
+func (cl *client) GetMany(bucket string, keys []string, opts GetManyOptions) (*GetManyResponse, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+
+	keys = uniqueKeys(keys)
+	res := &GetManyResponse{Values: map[string]json.RawMessage{}, ETags: map[string]string{}}
+	batchErr := &BatchError{Bucket: bucket, Errors: map[string]error{}}
+	resolve := resolveOnce(cl.resolver(bucket))
+
+	pending := keys
+	if opts.ListRatio > 0 && len(keys) >= minListKeys {
+		if listed, err := cl.getManyFromList(bucket, keys, opts.ListRatio*len(keys), resolve, res); err == nil {
+			pending = listed
+		}
+	}
+
+	var mu sync.Mutex
+	forEachKey(pending, opts.Concurrency, func(key string) {
+		req := cl.http.Get().
+			AddPath(fmt.Sprintf(metadataKeyPath, cl.appName, bucket, key))
+		httpRes, err := cl.performWithResolver(bucket, req, resolve)
+		var value []byte
+		if err == nil {
+			value = httpRes.Bytes()
+			if cl.validateReads {
+				err = cl.schemas.ValidateJSON(bucket, key, value)
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if clients.IsNotFound(err) {
+			res.NotFound = append(res.NotFound, key)
+		} else if err != nil {
+			batchErr.Errors[key] = err
+		} else {
+			res.Values[key] = value
+			res.ETags[key] = httpRes.Header.Get(clients.HeaderETag)
+		}
+	})
+
+	sort.Strings(res.NotFound)
+	if len(batchErr.Errors) > 0 {
+		return res, batchErr
+	}
+	return res, nil
+}
+
+// getManyFromList lists up to limit keys of the bucket with values, filling
+// res with the requested keys found, and returns the keys still to be read.
+// When the listing has the whole bucket, every key not found is missing.
+func (cl *client) getManyFromList(bucket string, keys []string, limit int, resolve resolveFunc, res *GetManyResponse) ([]string, error) {
+	list, _, err := cl.list(bucket, &Options{IncludeValue: true, Limit: limit}, resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]*MetadataResponseEntry, len(list.Data))
+	for _, entry := range list.Data {
+		listed[entry.Key] = entry
+	}
+	complete := list.NextMarker == ""
+
+	var pending []string
+	for _, key := range keys {
+		if entry, ok := listed[key]; ok {
+			res.Values[key] = entry.Value
+		} else if complete {
+			res.NotFound = append(res.NotFound, key)
+		} else {
+			pending = append(pending, key)
+		}
+	}
+	return pending, nil
+}
+
+// getMany reads keys with the client's GetMany if it is a BatchGetter, or
+// else with concurrent Gets
+func getMany(client Metadata, bucket string, keys []string, opts GetManyOptions) (*GetManyResponse, error) {
+	if getter, ok := client.(BatchGetter); ok {
+		return getter.GetMany(bucket, keys, opts)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+
+	res := &GetManyResponse{Values: map[string]json.RawMessage{}, ETags: map[string]string{}}
+	batchErr := &BatchError{Bucket: bucket, Errors: map[string]error{}}
+	var mu sync.Mutex
+	forEachKey(uniqueKeys(keys), opts.Concurrency, func(key string) {
+		var value json.RawMessage
+		hash, err := client.Get(bucket, key, &value)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if clients.IsNotFound(err) {
+			res.NotFound = append(res.NotFound, key)
+		} else if err != nil {
+			batchErr.Errors[key] = err
+		} else {
+			res.Values[key] = value
+			res.ETags[key] = hash
+		}
+	})
+
+	sort.Strings(res.NotFound)
+	if len(batchErr.Errors) > 0 {
+		return res, batchErr
+	}
+	return res, nil
+}
+
+// GetMany reads the values of keys with opts, decoding them into dest. It
+// returns the keys that don't exist, and reports the keys that couldn't be
+// read or decoded in a *BatchError.
+func GetMany[T any](client Metadata, bucket string, keys []string, dest map[string]T, opts GetManyOptions) ([]string, error) {
+	res, err := getMany(client, bucket, keys, opts)
+	batchErr, ok := err.(*BatchError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	if batchErr == nil {
+		batchErr = &BatchError{Bucket: bucket, Errors: map[string]error{}}
+	}
+
+	for key, raw := range res.Values {
+		var value T
+		if err := json.Unmarshal(raw, &value); err != nil {
+			batchErr.Errors[key] = err
+			continue
+		}
+		dest[key] = value
+	}
+	if len(batchErr.Errors) > 0 {
+		return res.NotFound, batchErr
+	}
+	return res.NotFound, nil
+}
+
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	unique := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
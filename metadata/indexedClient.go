@@ -0,0 +1,415 @@
+package metadata
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/common"
+)
+
+const indexChunkSize = 100
+
+// Index declares a secondary index of the values of Field in the keys of
+// Bucket
+type Index struct {
+	Bucket string
+	Field  string
+}
+
+// IndexedClient is a Metadata decorator maintaining secondary indexes, kept in
+// separate buckets, as values are written through it. An index holds one
+// document per value, listing the keys with that value, so that queries
+// created with its Query method read a single document for equality
+// conditions. Writes made by other clients, values changed by
+// ResolveConflicts, and concurrent updates of a same index document aren't
+// reflected until RebuildIndexes is called.
+type IndexedClient struct {
+	inner   Metadata
+	indexes map[string][]string
+}
+
+// NewIndexedClient wraps inner to maintain indexes
+func NewIndexedClient(inner Metadata, indexes []Index) *IndexedClient {
+	c := &IndexedClient{inner: inner, indexes: map[string][]string{}}
+	for _, index := range indexes {
+		c.indexes[index.Bucket] = append(c.indexes[index.Bucket], index.Field)
+	}
+	return c
+}
+
+// IndexBucket returns the name of the bucket holding the index of field in
+// bucket. Dots in field are replaced by underscores.
+func IndexBucket(bucket, field string) string {
+	return bucket + "-index-" + strings.Replace(field, ".", "_", -1)
+}
+
+// indexDocKey is the key of the index document listing the keys with value.
+// It is hex encoded, so that it is safe in paths.
+func indexDocKey(value interface{}) (string, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Query creates a Query over bucket using its indexes
+func (c *IndexedClient) Query(bucket string) *Query {
+	q := NewQuery(c, bucket)
+	q.indexes = c
+	return q
+}
+
+func (c *IndexedClient) hasIndex(bucket, field string) bool {
+	for _, indexed := range c.indexes[bucket] {
+		if indexed == field {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the keys whose field was indexed with value, reading the
+// value's index document
+func (c *IndexedClient) lookup(bucket, field string, value interface{}) ([]string, error) {
+	docKey, err := indexDocKey(value)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if _, err := c.inner.Get(IndexBucket(bucket, field), docKey, &keys); clients.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// current reads the decoded values of keys, leaving out missing ones
+func (c *IndexedClient) current(bucket string, keys []string) (map[string]interface{}, error) {
+	res, err := getMany(c.inner, bucket, keys, GetManyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	docs := make(map[string]interface{}, len(res.Values))
+	for key, raw := range res.Values {
+		var doc interface{}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("Error decoding %s: %v", key, err)
+		}
+		docs[key] = doc
+	}
+	return docs, nil
+}
+
+// indexChange lists the keys to add to and remove from an index document
+type indexChange struct {
+	add    []string
+	remove []string
+}
+
+// reindex updates the index documents of the values of keys that changed.
+// Keys missing from a map don't exist. The documents touched are read and
+// written back in a single request each per field.
+func (c *IndexedClient) reindex(bucket string, keys []string, before, after map[string]interface{}) error {
+	for _, field := range c.indexes[bucket] {
+		changes := map[string]*indexChange{}
+		change := func(value interface{}) (*indexChange, error) {
+			docKey, err := indexDocKey(value)
+			if err != nil {
+				return nil, err
+			}
+			if changes[docKey] == nil {
+				changes[docKey] = &indexChange{}
+			}
+			return changes[docKey], nil
+		}
+
+		for _, key := range keys {
+			oldValue, oldOk := lookupIndexed(before, key, field)
+			newValue, newOk := lookupIndexed(after, key, field)
+			if oldOk && newOk && reflect.DeepEqual(oldValue, newValue) {
+				continue
+			}
+			if oldOk {
+				ch, err := change(oldValue)
+				if err != nil {
+					return err
+				}
+				ch.remove = append(ch.remove, key)
+			}
+			if newOk {
+				ch, err := change(newValue)
+				if err != nil {
+					return err
+				}
+				ch.add = append(ch.add, key)
+			}
+		}
+		if len(changes) > 0 {
+			if err := c.updateIndexDocs(IndexBucket(bucket, field), changes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateIndexDocs applies changes to the index documents of indexBucket,
+// removing the ones left empty
+func (c *IndexedClient) updateIndexDocs(indexBucket string, changes map[string]*indexChange) error {
+	docKeys := make([]string, 0, len(changes))
+	for docKey := range changes {
+		docKeys = append(docKeys, docKey)
+	}
+	sort.Strings(docKeys)
+
+	res, err := getMany(c.inner, indexBucket, docKeys, GetManyOptions{})
+	if err != nil {
+		return err
+	}
+
+	patch := make(MetadataPatchRequest, 0, len(docKeys))
+	for _, docKey := range docKeys {
+		set := map[string]bool{}
+		if raw, ok := res.Values[docKey]; ok {
+			var indexed []string
+			if err := json.Unmarshal(raw, &indexed); err != nil {
+				return fmt.Errorf("Error decoding index %s/%s: %v", indexBucket, docKey, err)
+			}
+			for _, key := range indexed {
+				set[key] = true
+			}
+		}
+		for _, key := range changes[docKey].remove {
+			delete(set, key)
+		}
+		for _, key := range changes[docKey].add {
+			set[key] = true
+		}
+
+		if len(set) == 0 {
+			patch = append(patch, &PatchOperation{Type: OperationTypeRemove, Key: docKey})
+			continue
+		}
+		indexed := make([]string, 0, len(set))
+		for key := range set {
+			indexed = append(indexed, key)
+		}
+		sort.Strings(indexed)
+		patch = append(patch, &PatchOperation{Type: OperationTypeReplace, Key: docKey, Value: indexed})
+	}
+	return c.inner.DoAll(indexBucket, patch)
+}
+
+func lookupIndexed(docs map[string]interface{}, key, field string) (interface{}, bool) {
+	doc, ok := docs[key]
+	if !ok {
+		return nil, false
+	}
+	return lookupField(doc, field)
+}
+
+// RebuildIndexes recreates the indexes of bucket from its current values
+func (c *IndexedClient) RebuildIndexes(bucket string) error {
+	fields := c.indexes[bucket]
+	for _, field := range fields {
+		if err := c.inner.DeleteAll(IndexBucket(bucket, field)); err != nil {
+			return err
+		}
+	}
+
+	indexes := make([]map[string][]string, len(fields))
+	for i := range indexes {
+		indexes[i] = map[string][]string{}
+	}
+	marker := ""
+	for {
+		list, _, err := c.inner.List(bucket, &Options{IncludeValue: true, Limit: indexChunkSize, Marker: marker})
+		if err != nil {
+			return err
+		}
+		for _, entry := range list.Data {
+			var doc interface{}
+			if err := json.Unmarshal(entry.Value, &doc); err != nil {
+				continue
+			}
+			for i, field := range fields {
+				if value, ok := lookupField(doc, field); ok {
+					docKey, err := indexDocKey(value)
+					if err != nil {
+						return err
+					}
+					indexes[i][docKey] = append(indexes[i][docKey], entry.Key)
+				}
+			}
+		}
+		if list.NextMarker == "" || len(list.Data) == 0 {
+			break
+		}
+		marker = list.NextMarker
+	}
+
+	for i, field := range fields {
+		chunk := map[string]interface{}{}
+		for docKey, keys := range indexes[i] {
+			sort.Strings(keys)
+			chunk[docKey] = keys
+			if len(chunk) == indexChunkSize {
+				if _, err := c.inner.SaveAll(IndexBucket(bucket, field), chunk); err != nil {
+					return err
+				}
+				chunk = map[string]interface{}{}
+			}
+		}
+		if len(chunk) > 0 {
+			if _, err := c.inner.SaveAll(IndexBucket(bucket, field), chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *IndexedClient) GetBucket(bucket string) (*BucketResponse, string, error) {
+	return c.inner.GetBucket(bucket)
+}
+
+func (c *IndexedClient) SetBucketState(bucket string, state common.BucketState) error {
+	return c.inner.SetBucketState(bucket, state)
+}
+
+func (c *IndexedClient) List(bucket string, options *Options) (*MetadataListResponse, string, error) {
+	return c.inner.List(bucket, options)
+}
+
+func (c *IndexedClient) ListAll(bucket string, includeValue bool) (*MetadataListResponse, string, error) {
+	return c.inner.ListAll(bucket, includeValue)
+}
+
+func (c *IndexedClient) Get(bucket, key string, data interface{}) (string, error) {
+	return c.inner.Get(bucket, key, data)
+}
+
+func (c *IndexedClient) GetMany(bucket string, keys []string, opts GetManyOptions) (*GetManyResponse, error) {
+	return getMany(c.inner, bucket, keys, opts)
+}
+
+func (c *IndexedClient) Save(bucket, key string, data interface{}) (string, error) {
+	if len(c.indexes[bucket]) == 0 {
+		return c.inner.Save(bucket, key, data)
+	}
+	doc, err := normalize(data)
+	if err != nil {
+		return "", err
+	}
+	old, err := c.current(bucket, []string{key})
+	if err != nil {
+		return "", err
+	}
+	hash, err := c.inner.Save(bucket, key, data)
+	if err != nil {
+		return "", err
+	}
+	return hash, c.reindex(bucket, []string{key}, old, map[string]interface{}{key: doc})
+}
+
+func (c *IndexedClient) SaveAll(bucket string, data map[string]interface{}) (string, error) {
+	if len(c.indexes[bucket]) == 0 {
+		return c.inner.SaveAll(bucket, data)
+	}
+	keys := sortedKeys(data)
+	docs := make(map[string]interface{}, len(data))
+	for _, key := range keys {
+		doc, err := normalize(data[key])
+		if err != nil {
+			return "", err
+		}
+		docs[key] = doc
+	}
+	old, err := c.current(bucket, keys)
+	if err != nil {
+		return "", err
+	}
+	hash, err := c.inner.SaveAll(bucket, data)
+	if err != nil {
+		return "", err
+	}
+	return hash, c.reindex(bucket, keys, old, docs)
+}
+
+func (c *IndexedClient) DoAll(bucket string, patch MetadataPatchRequest) error {
+	return c.DoAllWithOptions(bucket, patch, DoAllOptions{})
+}
+
+// DoAllWithOptions applies the patch, then indexes the values read back from
+// the touched keys, so that partially applied patches are indexed correctly
+func (c *IndexedClient) DoAllWithOptions(bucket string, patch MetadataPatchRequest, opts DoAllOptions) error {
+	if len(c.indexes[bucket]) == 0 {
+		return c.inner.DoAllWithOptions(bucket, patch, opts)
+	}
+	var keys []string
+	seen := map[string]bool{}
+	for _, op := range patch {
+		if !seen[op.Key] {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+	old, err := c.current(bucket, keys)
+	if err != nil {
+		return err
+	}
+	patchErr := c.inner.DoAllWithOptions(bucket, patch, opts)
+	if pe, ok := patchErr.(*PatchError); ok && !pe.Applied {
+		return patchErr
+	}
+	updated, err := c.current(bucket, keys)
+	if err != nil {
+		return err
+	}
+	if err := c.reindex(bucket, keys, old, updated); err != nil {
+		return err
+	}
+	return patchErr
+}
+
+func (c *IndexedClient) Delete(bucket, key string) (bool, error) {
+	if len(c.indexes[bucket]) == 0 {
+		return c.inner.Delete(bucket, key)
+	}
+	old, err := c.current(bucket, []string{key})
+	if err != nil {
+		return false, err
+	}
+	deleted, err := c.inner.Delete(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	return deleted, c.reindex(bucket, []string{key}, old, nil)
+}
+
+func (c *IndexedClient) DeleteAll(bucket string) error {
+	if err := c.inner.DeleteAll(bucket); err != nil {
+		return err
+	}
+	for _, field := range c.indexes[bucket] {
+		if err := c.inner.DeleteAll(IndexBucket(bucket, field)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *IndexedClient) ListAllConflicts(bucket string) ([]*MetadataConflict, error) {
+	return c.inner.ListAllConflicts(bucket)
+}
+
+func (c *IndexedClient) ResolveConflicts(bucket string, patch MetadataPatchRequest) error {
+	return c.inner.ResolveConflicts(bucket, patch)
+}
@@ -0,0 +1,148 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vtex/go-clients/clients"
+)
+
+var (
+	// ErrSkipEntry is returned by a migration Transform to leave an entry out
+	ErrSkipEntry = errors.New("Skip entry")
+	// ErrKeyCollision is the cause of the failures of entries transformed to
+	// the destination key of an entry already migrated
+	ErrKeyCollision = errors.New("Destination key collision")
+)
+
+// MigrateEntry is a key being migrated. Transform functions may change both
+// its key and value.
+type MigrateEntry struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// MigrateOptions configures Migrate
+type MigrateOptions struct {
+	// DstBucket is the destination bucket. Defaults to the source bucket.
+	DstBucket string
+	// Transform, if set, is called with every entry before it is saved. It
+	// may return ErrSkipEntry to leave the entry out; other errors are
+	// recorded in the report and the entry is skipped.
+	Transform func(entry *MigrateEntry) error
+	// BatchSize is the number of keys read and saved at once. Defaults to 100.
+	BatchSize int
+	// Marker resumes a migration from a marker passed to OnCheckpoint
+	Marker string
+	// OnCheckpoint, if set, is called after each batch is saved with the
+	// marker to resume from, empty when the migration is complete. Failing
+	// stops the migration.
+	OnCheckpoint func(marker string) error
+	// DryRun reads and transforms entries without saving them
+	DryRun bool
+}
+
+// MigrateFailure is an entry that couldn't be transformed, or whose
+// destination key collides with the one of an entry already migrated
+type MigrateFailure struct {
+	Key string
+	Err error
+}
+
+// MigrateReport summarizes a migration
+type MigrateReport struct {
+	Read int
+	// Written counts the keys saved, or that would be saved in a dry run
+	Written  int
+	Skipped  int
+	Failures []MigrateFailure
+	// Marker resumes the migration when it stopped early
+	Marker   string
+	Duration time.Duration
+}
+
+func (r *MigrateReport) String() string {
+	return fmt.Sprintf("%d read, %d written, %d skipped, %d failed in %v", r.Read, r.Written, r.Skipped, len(r.Failures), r.Duration)
+}
+
+// Migrate copies the keys of bucket from src to dst, e.g. clients created for
+// different apps, workspaces or accounts, saving them in batches. An entry
+// transformed to the same destination key as a previous one isn't saved and is
+// reported as a failure. Collisions with entries migrated before resuming from
+// a Marker aren't detected.
+func Migrate(src, dst Metadata, bucket string, opts MigrateOptions) (*MigrateReport, error) {
+	if opts.DstBucket == "" {
+		opts.DstBucket = bucket
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+
+	start := time.Now()
+	report := &MigrateReport{Marker: opts.Marker}
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+
+	// sources maps each destination key to the source key migrated to it
+	sources := map[string]string{}
+	for {
+		list, _, err := src.List(bucket, &Options{IncludeValue: true, Limit: opts.BatchSize, Marker: report.Marker})
+		if err != nil {
+			return report, err
+		}
+
+		batch := make(map[string]interface{}, len(list.Data))
+		for _, entry := range list.Data {
+			report.Read++
+			migrated := &MigrateEntry{Key: entry.Key, Value: entry.Value}
+			if opts.Transform != nil {
+				if err := opts.Transform(migrated); err == ErrSkipEntry {
+					report.Skipped++
+					continue
+				} else if err != nil {
+					report.Failures = append(report.Failures, MigrateFailure{entry.Key, err})
+					continue
+				}
+			}
+			if source, ok := sources[migrated.Key]; ok {
+				err := errors.Wrapf(ErrKeyCollision, "%s was already migrated from %s", migrated.Key, source)
+				report.Failures = append(report.Failures, MigrateFailure{entry.Key, err})
+				continue
+			}
+			sources[migrated.Key] = entry.Key
+			batch[migrated.Key] = migrated.Value
+		}
+
+		if len(batch) > 0 && !opts.DryRun {
+			if _, err := dst.SaveAll(opts.DstBucket, batch); err != nil {
+				return report, err
+			}
+		}
+		report.Written += len(batch)
+
+		next := list.NextMarker
+		if len(list.Data) == 0 {
+			next = ""
+		}
+		if opts.OnCheckpoint != nil && !opts.DryRun {
+			if err := opts.OnCheckpoint(next); err != nil {
+				return report, err
+			}
+		}
+		report.Marker = next
+		if next == "" {
+			return report, nil
+		}
+	}
+}
+
+// MigrateApp copies a bucket of srcApp to dstApp, e.g. after an app is
+// renamed, using the account and workspace in config
+func MigrateApp(config *clients.Config, srcApp, dstApp, bucket string, opts MigrateOptions) (*MigrateReport, error) {
+	src := NewCustomAppClient(srcApp, config, nil)
+	dst := NewCustomAppClient(dstApp, config, nil)
+	return Migrate(src, dst, bucket, opts)
+}
@@ -0,0 +1,344 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vtex/go-clients/clients"
+)
+
+const queryPageSize = 100
+
+// Query selects the keys of a bucket by the fields of their JSON values. Fields
+// are dotted paths, e.g. "address.city", where numeric segments index arrays.
+// Conditions are evaluated on the client, over the bucket listed page by
+// page, unless an index of an IndexedClient can narrow the keys read.
+type Query struct {
+	client  Metadata
+	indexes *IndexedClient
+	bucket  string
+	conds   []condition
+	orderBy string
+	desc    bool
+	limit   int
+	err     error
+}
+
+type condition struct {
+	field string
+	op    string
+	value interface{}
+}
+
+// NewQuery creates a Query over every key in bucket
+func NewQuery(client Metadata, bucket string) *Query {
+	return &Query{client: client, bucket: bucket}
+}
+
+// Querier is implemented by Metadata clients creating their own queries, such
+// as IndexedClient, which uses its indexes
+type Querier interface {
+	Query(bucket string) *Query
+}
+
+// Query creates a Query over bucket, evaluated on the client
+func (cl *client) Query(bucket string) *Query {
+	return NewQuery(cl, bucket)
+}
+
+// Where keeps the keys whose field compares to value with op, one of "=",
+// "!=", "<", "<=", ">", ">=" and "in", for which value must be a slice. Values
+// are compared as JSON, so numbers of any Go type match JSON numbers.
+// Missing fields never match.
+func (q *Query) Where(field, op string, value interface{}) *Query {
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=", "in":
+	default:
+		q.setErr(fmt.Errorf("Invalid query operator %q", op))
+		return q
+	}
+	normalized, err := normalize(value)
+	if err != nil {
+		q.setErr(fmt.Errorf("Invalid value for %s: %v", field, err))
+		return q
+	}
+	if _, ok := normalized.([]interface{}); op == "in" && !ok {
+		q.setErr(fmt.Errorf("Value for %s in must be a slice", field))
+		return q
+	}
+	q.conds = append(q.conds, condition{field, op, normalized})
+	return q
+}
+
+// OrderBy sorts results by field, ascending. Keys missing the field come last.
+func (q *Query) OrderBy(field string) *Query {
+	q.orderBy, q.desc = field, false
+	return q
+}
+
+// OrderByDesc sorts results by field, descending. Keys missing the field come
+// last.
+func (q *Query) OrderByDesc(field string) *Query {
+	q.orderBy, q.desc = field, true
+	return q
+}
+
+// Limit bounds the number of results. Without an order, the bucket is only
+// read until enough keys match.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Run returns the matching entries, sorted by key unless ordered by a field
+func (q *Query) Run() ([]*MetadataResponseEntry, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	var matches []*queryMatch
+	done := func() bool {
+		return q.orderBy == "" && q.limit > 0 && len(matches) >= q.limit
+	}
+	err := q.scan(func(entry *MetadataResponseEntry) (bool, error) {
+		var doc interface{}
+		if err := json.Unmarshal(entry.Value, &doc); err != nil {
+			return false, fmt.Errorf("Error decoding %s: %v", entry.Key, err)
+		}
+		if q.matches(doc) {
+			matches = append(matches, &queryMatch{entry, doc})
+		}
+		return !done(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if q.orderBy != "" {
+		sort.SliceStable(matches, func(i, j int) bool {
+			a, aOk := lookupField(matches[i].doc, q.orderBy)
+			b, bOk := lookupField(matches[j].doc, q.orderBy)
+			if !aOk || !bOk {
+				return aOk && !bOk
+			}
+			if q.desc {
+				return compareJSON(a, b) > 0
+			}
+			return compareJSON(a, b) < 0
+		})
+	}
+	if q.limit > 0 && len(matches) > q.limit {
+		matches = matches[:q.limit]
+	}
+
+	entries := make([]*MetadataResponseEntry, len(matches))
+	for i, match := range matches {
+		entries[i] = match.entry
+	}
+	return entries, nil
+}
+
+// Decode runs the query and unmarshals the values of the results into dest,
+// which must be a pointer to a slice
+func (q *Query) Decode(dest interface{}) error {
+	entries, err := q.Run()
+	if err != nil {
+		return err
+	}
+	values := make([]json.RawMessage, len(entries))
+	for i, entry := range entries {
+		values[i] = entry.Value
+	}
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dest)
+}
+
+type queryMatch struct {
+	entry *MetadataResponseEntry
+	doc   interface{}
+}
+
+func (q *Query) setErr(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// scan calls fn with the candidate entries of the query until it returns false
+func (q *Query) scan(fn func(entry *MetadataResponseEntry) (bool, error)) error {
+	if q.indexes != nil {
+		for _, cond := range q.conds {
+			if cond.op == "=" && q.indexes.hasIndex(q.bucket, cond.field) {
+				return q.scanIndex(cond, fn)
+			}
+		}
+	}
+
+	marker := ""
+	for {
+		list, _, err := q.client.List(q.bucket, &Options{IncludeValue: true, Limit: queryPageSize, Marker: marker})
+		if err != nil {
+			return err
+		}
+		for _, entry := range list.Data {
+			if more, err := fn(entry); err != nil || !more {
+				return err
+			}
+		}
+		if list.NextMarker == "" || len(list.Data) == 0 {
+			return nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+// scanIndex reads the keys listed in the index for an equality condition.
+// Every condition is still checked against the values read, since indexes may
+// lag behind writes made by other clients.
+func (q *Query) scanIndex(cond condition, fn func(entry *MetadataResponseEntry) (bool, error)) error {
+	keys, err := q.indexes.lookup(q.bucket, cond.field, cond.value)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var value json.RawMessage
+		hash, err := q.client.Get(q.bucket, key, &value)
+		if clients.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if more, err := fn(&MetadataResponseEntry{Key: key, Hash: hash, Value: value}); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Query) matches(doc interface{}) bool {
+	for _, cond := range q.conds {
+		value, ok := lookupField(doc, cond.field)
+		if !ok || !cond.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c condition) matches(value interface{}) bool {
+	switch c.op {
+	case "=":
+		return reflect.DeepEqual(value, c.value)
+	case "!=":
+		return !reflect.DeepEqual(value, c.value)
+	case "in":
+		for _, candidate := range c.value.([]interface{}) {
+			if reflect.DeepEqual(value, candidate) {
+				return true
+			}
+		}
+		return false
+	}
+	if typeRank(value) != typeRank(c.value) {
+		return false
+	}
+	cmp := compareJSON(value, c.value)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// normalize converts value to the types of decoded JSON
+func normalize(value interface{}) (interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalized interface{}
+	err = json.Unmarshal(raw, &normalized)
+	return normalized, err
+}
+
+// lookupField returns the value of a dotted field in a decoded JSON document
+func lookupField(doc interface{}, field string) (interface{}, bool) {
+	value := doc
+	for _, segment := range strings.Split(field, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[segment]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// typeRank orders values of different JSON types: null, booleans, numbers,
+// strings, arrays and objects
+func typeRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case []interface{}:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// compareJSON orders decoded JSON values. Arrays and objects of a same type
+// are considered equal.
+func compareJSON(a, b interface{}) int {
+	if ra, rb := typeRank(a), typeRank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		if a < b.(float64) {
+			return -1
+		} else if a > b.(float64) {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
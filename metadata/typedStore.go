@@ -0,0 +1,105 @@
+package metadata
+
+import (
+	"encoding/json"
+
+	"github.com/vtex/go-clients/codec"
+	"github.com/vtex/go-clients/internal/typed"
+)
+
+// TypedStoreOptions configures a TypedStore
+type TypedStoreOptions[T any] struct {
+	// Codec serializes values. Defaults to codec.JSON.
+	Codec codec.Codec
+	// Validate, if set, is called with every value before it is saved
+	Validate func(key string, value T) error
+}
+
+// TypedStore stores values of type T as keys in a Metadata bucket
+type TypedStore[T any] struct {
+	client Metadata
+	bucket string
+	store  typed.Store[T]
+}
+
+// NewTypedStore creates a TypedStore over a bucket
+func NewTypedStore[T any](client Metadata, bucket string, opts TypedStoreOptions[T]) *TypedStore[T] {
+	if opts.Codec == nil {
+		opts.Codec = codec.JSON
+	}
+	return &TypedStore[T]{client, bucket, typed.Store[T]{
+		Backend:  typedBackend{client, bucket},
+		Codec:    opts.Codec,
+		Validate: opts.Validate,
+	}}
+}
+
+// Get decodes the value stored at key
+func (s *TypedStore[T]) Get(key string) (T, string, error) {
+	return s.store.Get(key)
+}
+
+// Put validates and saves value at key
+func (s *TypedStore[T]) Put(key string, value T) (string, error) {
+	return s.store.Put(key, value)
+}
+
+// Delete removes the value at key, returning false if it didn't exist
+func (s *TypedStore[T]) Delete(key string) (bool, error) {
+	return s.client.Delete(s.bucket, key)
+}
+
+// List calls fn with every value in the bucket, stopping at the first error
+// returned by fn.
+func (s *TypedStore[T]) List(fn func(key string, value T) error) error {
+	options := &Options{IncludeValue: true, Limit: 100}
+	for {
+		list, _, err := s.client.List(s.bucket, options)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range list.Data {
+			value, err := s.store.Decode(entry.Value)
+			if err != nil {
+				return err
+			}
+			if err := fn(entry.Key, value); err != nil {
+				return err
+			}
+		}
+
+		if list.NextMarker == "" {
+			return nil
+		}
+		options.Marker = list.NextMarker
+	}
+}
+
+// Update reads the value at key, applies mutate and saves the result only if
+// the key didn't change meanwhile, retrying with the new value otherwise. The
+// exists argument of mutate is false if there was no value at key. Clients not
+// implementing ConditionalSaver can't detect concurrent changes, which are
+// then lost.
+func (s *TypedStore[T]) Update(key string, mutate func(value T, exists bool) (T, error)) (T, string, error) {
+	return s.store.Update(key, mutate)
+}
+
+type typedBackend struct {
+	client Metadata
+	bucket string
+}
+
+func (b typedBackend) Get(key string) (json.RawMessage, string, error) {
+	var raw json.RawMessage
+	eTag, err := b.client.Get(b.bucket, key, &raw)
+	return raw, eTag, err
+}
+
+func (b typedBackend) Save(key string, raw json.RawMessage, cond typed.Condition) (string, error) {
+	saver, ok := b.client.(ConditionalSaver)
+	if !ok || cond == (typed.Condition{}) {
+		return b.client.Save(b.bucket, key, raw)
+	}
+	return saver.SaveIfMatch(b.bucket, key, raw, cond.IfMatch)
+}
@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
 	"sync/atomic"
 
 	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/common"
+	"github.com/vtex/go-clients/internal/fsutil"
 	"github.com/vtex/go-clients/metadata"
 )
 
@@ -27,16 +30,48 @@ type fakeMetadata struct {
 	buckets map[string]*bucket
 }
 
-func (r *fakeMetadata) GetBucket(bucket string) (*metadata.BucketResponse, string, error) {
-	panic("not implemented")
+func (r *fakeMetadata) GetBucket(bucketName string) (*metadata.BucketResponse, string, error) {
+	r.Lock()
+	defer r.Unlock()
+	bucket := r.getBucket(bucketName)
+	return &metadata.BucketResponse{Hash: bucket.eTag}, bucket.eTag, nil
 }
 
-func (r *fakeMetadata) SetBucketState(bucket, state string) error {
+func (r *fakeMetadata) SetBucketState(bucket string, state common.BucketState) error {
 	panic("not implemented")
 }
 
-func (r *fakeMetadata) List(bucket string, options *metadata.Options) (*metadata.MetadataListResponse, string, error) {
-	panic("not implemented")
+func (r *fakeMetadata) List(bucketName string, options *metadata.Options) (*metadata.MetadataListResponse, string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	limit := options.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+
+	bucket := r.getBucket(bucketName)
+	entries := make([]*metadata.MetadataResponseEntry, 0, len(bucket.entries))
+	for _, entry := range bucket.entries {
+		if entry.Key >= options.Marker {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	list := &metadata.MetadataListResponse{}
+	if len(entries) > limit {
+		list.NextMarker = entries[limit].Key
+		entries = entries[:limit]
+	}
+	for _, entry := range entries {
+		listed := &metadata.MetadataResponseEntry{Key: entry.Key, Hash: entry.Hash}
+		if options.IncludeValue {
+			listed.Value = entry.Value
+		}
+		list.Data = append(list.Data, listed)
+	}
+	return list, bucket.eTag, nil
 }
 
 func (r *fakeMetadata) ListAll(bucketName string, includeValue bool) (*metadata.MetadataListResponse, string, error) {
@@ -59,6 +94,25 @@ func (r *fakeMetadata) Get(bucket, key string, data interface{}) (string, error)
 	return entry.Hash, nil
 }
 
+func (r *fakeMetadata) GetMany(bucket string, keys []string, opts metadata.GetManyOptions) (*metadata.GetManyResponse, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	res := &metadata.GetManyResponse{Values: map[string]json.RawMessage{}, ETags: map[string]string{}}
+	missing := map[string]bool{}
+	for _, key := range keys {
+		if _, entry, ok := r.getEntry(bucket, key); ok {
+			res.Values[key] = entry.Value
+			res.ETags[key] = entry.Hash
+		} else if !missing[key] {
+			missing[key] = true
+			res.NotFound = append(res.NotFound, key)
+		}
+	}
+	sort.Strings(res.NotFound)
+	return res, nil
+}
+
 func (r *fakeMetadata) Save(bucketName, key string, data interface{}) (string, error) {
 	r.Lock()
 	defer r.Unlock()
@@ -70,15 +124,17 @@ func (r *fakeMetadata) saveNoLock(bucketName, key string, data interface{}) (str
 	if err != nil {
 		return "", err
 	}
+	// Hashes are derived from values, as in metadata/fsbackend, so that equal
+	// values have equal hashes across buckets
 	bucket, entry, ok := r.getEntry(bucketName, key)
 	if ok {
 		entry.Value = raw
-		entry.Hash = genEtag()
+		entry.Hash = fsutil.ContentHash(raw)
 	} else {
 		entry = &metadata.MetadataResponseEntry{
 			Key:   key,
 			Value: raw,
-			Hash:  genEtag(),
+			Hash:  fsutil.ContentHash(raw),
 		}
 		bucket.entries = append(bucket.entries, entry)
 	}
@@ -86,6 +142,17 @@ func (r *fakeMetadata) saveNoLock(bucketName, key string, data interface{}) (str
 	return entry.Hash, nil
 }
 
+func (r *fakeMetadata) SaveIfMatch(bucketName, key string, data interface{}, hash string) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	_, entry, ok := r.getEntry(bucketName, key)
+	if (hash == "" && ok) || (hash != "" && (!ok || entry.Hash != hash)) {
+		return "", clients.ResponseError{StatusCode: http.StatusPreconditionFailed}
+	}
+	return r.saveNoLock(bucketName, key, data)
+}
+
 func (r *fakeMetadata) SaveAll(bucket string, data map[string]interface{}) (string, error) {
 	r.Lock()
 	defer r.Unlock()
@@ -100,18 +167,46 @@ func (r *fakeMetadata) SaveAll(bucket string, data map[string]interface{}) (stri
 }
 
 func (r *fakeMetadata) DoAll(bucket string, patch metadata.MetadataPatchRequest) error {
-	for _, p := range patch {
+	return r.DoAllWithOptions(bucket, patch, metadata.DoAllOptions{})
+}
+
+// DoAllWithOptions applies the patch under the lock, so it is always
+// all-or-nothing and only the Strict option makes a difference
+func (r *fakeMetadata) DoAllWithOptions(bucketName string, patch metadata.MetadataPatchRequest, opts metadata.DoAllOptions) error {
+	r.Lock()
+	defer r.Unlock()
+
+	patchErr := &metadata.PatchError{Bucket: bucketName}
+	exists := map[string]bool{}
+	for i, p := range patch {
+		keyExists, ok := exists[p.Key]
+		if !ok {
+			_, _, keyExists = r.getEntry(bucketName, p.Key)
+		}
 		var err error
 		switch p.Type {
 		case metadata.OperationTypeAdd:
-		case metadata.OperationTypeReplace:
-			_, err = r.Save(bucket, p.Key, p.Value)
-		case metadata.OperationTypeRemove:
-			_, err = r.Delete(bucket, p.Key)
+		case metadata.OperationTypeReplace, metadata.OperationTypeRemove:
+			if opts.Strict && !keyExists {
+				err = clients.ResponseError{StatusCode: http.StatusNotFound, Code: "NotFound", Message: "Key " + p.Key + " doesn't exist"}
+			}
 		default:
-			panic("not implemented")
+			err = fmt.Errorf("Invalid operation type %q", p.Type)
 		}
 		if err != nil {
+			patchErr.Failed = append(patchErr.Failed, &metadata.PatchOpError{Index: i, Op: p, Err: err})
+			continue
+		}
+		exists[p.Key] = p.Type != metadata.OperationTypeRemove
+	}
+	if len(patchErr.Failed) > 0 {
+		return patchErr
+	}
+
+	for _, p := range patch {
+		if p.Type == metadata.OperationTypeRemove {
+			r.deleteNoLock(bucketName, p.Key)
+		} else if _, err := r.saveNoLock(bucketName, p.Key, p.Value); err != nil {
 			return err
 		}
 	}
@@ -121,15 +216,32 @@ func (r *fakeMetadata) DoAll(bucket string, patch metadata.MetadataPatchRequest)
 func (r *fakeMetadata) Delete(bucketName, key string) (bool, error) {
 	r.Lock()
 	defer r.Unlock()
+	return r.deleteNoLock(bucketName, key), nil
+}
 
+func (r *fakeMetadata) DeleteIfMatch(bucketName, key, hash string) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	_, entry, ok := r.getEntry(bucketName, key)
+	if !ok {
+		return false, nil
+	}
+	if entry.Hash != hash {
+		return false, clients.ResponseError{StatusCode: http.StatusPreconditionFailed}
+	}
+	return r.deleteNoLock(bucketName, key), nil
+}
+
+func (r *fakeMetadata) deleteNoLock(bucketName, key string) bool {
 	bucket := r.getBucket(bucketName)
 	idx, _, ok := findEntry(bucket.entries, key)
 	if !ok {
-		return false, nil
+		return false
 	}
 	bucket.entries = append(bucket.entries[:idx], bucket.entries[idx+1:]...)
 	bucket.eTag = genEtag()
-	return true, nil
+	return true
 }
 
 func (r *fakeMetadata) DeleteAll(bucketName string) error {
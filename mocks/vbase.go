@@ -2,16 +2,21 @@ package mocks
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/vtex/go-io/ioext"
 
 	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/common"
 	"github.com/vtex/go-clients/vbase"
 )
 
@@ -30,6 +35,7 @@ type vbaseEntry struct {
 type vbaseBucket struct {
 	entries map[string]*vbaseEntry
 	eTag    string
+	state   common.BucketState
 }
 
 type fakeVbase struct {
@@ -38,7 +44,38 @@ type fakeVbase struct {
 }
 
 func (r *fakeVbase) GetBucket(bucket string) (*vbase.BucketResponse, string, error) {
-	panic("not implemented")
+	r.Lock()
+	defer r.Unlock()
+
+	buck := r.getBucket(bucket)
+	return &vbase.BucketResponse{Hash: buck.eTag, State: buck.state}, buck.eTag, nil
+}
+
+func (r *fakeVbase) SetBucketState(bucket string, state common.BucketState) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.getBucket(bucket).state = state
+	return nil
+}
+
+// ListBuckets lists every bucket used in the fake, regardless of appName
+func (r *fakeVbase) ListBuckets(appName string) ([]*vbase.BucketResponse, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	names := make([]string, 0, len(r.buckets))
+	for name := range r.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buckets := make([]*vbase.BucketResponse, len(names))
+	for i, name := range names {
+		buck := r.buckets[name]
+		buckets[i] = &vbase.BucketResponse{Name: name, Hash: buck.eTag, State: buck.state}
+	}
+	return buckets, nil
 }
 
 func (r *fakeVbase) ListAllConflicts(bucket string) ([]*vbase.Conflict, error) {
@@ -50,11 +87,40 @@ func (r *fakeVbase) ResolveConflicts(bucket string, patch vbase.PatchRequest) er
 }
 
 func (r *fakeVbase) ListFiles(bucket string, options *vbase.Options) (*vbase.FileListResponse, string, error) {
-	panic("deprecated api")
+	r.Lock()
+	defer r.Unlock()
+
+	if options.Limit <= 0 {
+		options.Limit = 10
+	}
+
+	buck := r.getBucket(bucket)
+	paths := make([]string, 0, len(buck.entries))
+	for path := range buck.entries {
+		if strings.HasPrefix(path, options.Prefix) && path >= options.Marker {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	list := &vbase.FileListResponse{}
+	if len(paths) > options.Limit {
+		list.NextMarker = paths[options.Limit]
+		paths = paths[:options.Limit]
+	}
+	for _, path := range paths {
+		entry := buck.entries[path]
+		file := &vbase.FileEntryResponse{Path: path, Hash: entry.eTag}
+		if entry.contentType == "application/json" {
+			file.Value = entry.value
+		}
+		list.Files = append(list.Files, file)
+	}
+	return list, buck.eTag, nil
 }
 
 func (r *fakeVbase) ListAllFiles(bucket, prefix string) (*vbase.FileListResponse, string, error) {
-	panic("deprecated api")
+	return r.ListFiles(bucket, &vbase.Options{Prefix: prefix, Limit: math.MaxInt32})
 }
 
 func (r *fakeVbase) DeleteAllFiles(bucket string) error {
@@ -72,6 +138,44 @@ func (r *fakeVbase) GetFile(bucket, path string) (file io.ReadCloser, contentTyp
 	return ioutil.NopCloser(bytes.NewReader(entry.value)), entry.contentType, nil
 }
 
+func (r *fakeVbase) GetFileRange(bucket, path string, offset, length int64) (*vbase.FileRange, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	_, entry, ok := r.getEntry(bucket, path)
+	if !ok {
+		return nil, clients.ResponseError{StatusCode: http.StatusNotFound}
+	}
+	size := int64(len(entry.value))
+	if offset >= size {
+		return nil, clients.ResponseError{StatusCode: http.StatusRequestedRangeNotSatisfiable}
+	}
+	if offset+length > size {
+		length = size - offset
+	}
+	return &vbase.FileRange{
+		ReadCloser:  ioutil.NopCloser(bytes.NewReader(entry.value[offset : offset+length])),
+		ContentType: entry.contentType,
+		ETag:        entry.eTag,
+		Partial:     true,
+		Offset:      offset,
+		Length:      length,
+		TotalSize:   size,
+	}, nil
+}
+
+func (r *fakeVbase) Download(ctx context.Context, bucket, path string, w io.WriterAt, opts vbase.DownloadOptions) error {
+	r.Lock()
+	defer r.Unlock()
+
+	_, entry, ok := r.getEntry(bucket, path)
+	if !ok {
+		return clients.ResponseError{StatusCode: http.StatusNotFound}
+	}
+	_, err := w.WriteAt(entry.value, 0)
+	return err
+}
+
 func (r *fakeVbase) GetJSON(bucket, path string, data interface{}) (string, error) {
 	r.Lock()
 	defer r.Unlock()
@@ -95,6 +199,25 @@ func (r *fakeVbase) SaveFile(bucket, path string, body io.Reader, opts vbase.Sav
 	return r.SaveFileB(bucket, path, bytes, opts)
 }
 
+func (r *fakeVbase) Upload(ctx context.Context, bucket, path string, body io.Reader, opts vbase.UploadOptions) (string, error) {
+	var sent int64
+	buf := make([]byte, 32*1024)
+	content := []byte{}
+	for {
+		n, err := body.Read(buf)
+		content = append(content, buf[:n]...)
+		if sent += int64(n); n > 0 && opts.Progress != nil {
+			opts.Progress(sent, opts.Size)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return r.SaveFileB(bucket, path, content, opts.SaveFileOptions)
+}
+
 func (r *fakeVbase) SaveJSON(bucket, path string, data interface{}) (string, error) {
 	bytes, err := json.Marshal(data)
 	if err != nil {
@@ -110,6 +233,9 @@ func (r *fakeVbase) SaveFileB(bucket, path string, bytes []byte, opts vbase.Save
 	defer r.Unlock()
 
 	buck := r.getBucket(bucket)
+	if !preconditionsMet(buck.entries[path], opts) {
+		return "", clients.ResponseError{StatusCode: http.StatusPreconditionFailed}
+	}
 	buck.eTag = genEtag()
 
 	if !opts.Unzip {
@@ -118,7 +244,7 @@ func (r *fakeVbase) SaveFileB(bucket, path string, bytes []byte, opts vbase.Save
 		}
 		entry := &vbaseEntry{
 			value:       bytes,
-			eTag:        genEtag(),
+			eTag:        vbase.ContentHash(bytes),
 			contentType: opts.ContentType,
 		}
 		buck.entries[path] = entry
@@ -133,13 +259,23 @@ func (r *fakeVbase) SaveFileB(bucket, path string, bytes []byte, opts vbase.Save
 		fullPath := filepath.Join(path, filePath)
 		buck.entries[fullPath] = &vbaseEntry{
 			value:       content,
-			eTag:        genEtag(),
+			eTag:        vbase.ContentHash(content),
 			contentType: "text/plain",
 		}
 	}
 	return buck.eTag, nil
 }
 
+func preconditionsMet(entry *vbaseEntry, opts vbase.SaveFileOptions) bool {
+	if opts.IfMatch != "" && (entry == nil || (opts.IfMatch != "*" && opts.IfMatch != entry.eTag)) {
+		return false
+	}
+	if opts.IfNoneMatch != "" && entry != nil && (opts.IfNoneMatch == "*" || opts.IfNoneMatch == entry.eTag) {
+		return false
+	}
+	return true
+}
+
 func (r *fakeVbase) DeleteFile(bucket, path string) error {
 	r.Lock()
 	defer r.Unlock()
@@ -150,15 +286,93 @@ func (r *fakeVbase) DeleteFile(bucket, path string) error {
 	}
 
 	delete(buck.entries, path)
+	buck.eTag = genEtag()
+	return nil
+}
+
+func (r *fakeVbase) DeleteFileIfMatch(bucket, path, eTag string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	buck := r.getBucket(bucket)
+	entry, exists := buck.entries[path]
+	if !exists {
+		return clients.ResponseError{StatusCode: http.StatusNotFound}
+	}
+	if entry.eTag != eTag {
+		return clients.ResponseError{StatusCode: http.StatusPreconditionFailed}
+	}
+
+	delete(buck.entries, path)
+	buck.eTag = genEtag()
+	return nil
+}
+
+func (r *fakeVbase) DeleteMany(bucket string, paths []string, opts vbase.DeleteOptions) error {
+	r.Lock()
+	defer r.Unlock()
+
+	buck := r.getBucket(bucket)
+	batchErr := &vbase.BatchError{Bucket: bucket, Errors: map[string]error{}}
+	for _, path := range paths {
+		if _, exists := buck.entries[path]; !exists {
+			if !opts.IgnoreNotFound {
+				batchErr.Errors[path] = clients.ResponseError{StatusCode: http.StatusNotFound}
+			}
+			continue
+		}
+		delete(buck.entries, path)
+		buck.eTag = genEtag()
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+func (r *fakeVbase) DeletePrefix(bucket, prefix string, opts vbase.DeleteOptions) error {
+	r.Lock()
+	defer r.Unlock()
+
+	buck := r.getBucket(bucket)
+	for path := range buck.entries {
+		if strings.HasPrefix(path, prefix) {
+			delete(buck.entries, path)
+			buck.eTag = genEtag()
+		}
+	}
 	return nil
 }
 
+// CorruptVBaseFile changes the content of a file stored in a fake created by
+// NewVBase, keeping its ETag and hash, so that integrity checks fail.
+func CorruptVBaseFile(client vbase.VBase, bucket, path string) bool {
+	r := client.(*fakeVbase)
+	r.Lock()
+	defer r.Unlock()
+
+	_, entry, ok := r.getEntry(bucket, path)
+	if !ok {
+		return false
+	}
+	corrupted := append([]byte{}, entry.value...)
+	if len(corrupted) == 0 {
+		corrupted = []byte{0}
+	} else {
+		corrupted[0] ^= 0xff
+	}
+	entry.value = corrupted
+	return true
+}
+
 func (r *fakeVbase) getBucket(name string) *vbaseBucket {
 	buck, ok := r.buckets[name]
 	if !ok {
 		buck = &vbaseBucket{
 			entries: map[string]*vbaseEntry{},
 			eTag:    genEtag(),
+			state:   common.BucketStateActive,
 		}
 		r.buckets[name] = buck
 	}
@@ -62,7 +62,7 @@ func (r *fakeVbaseChronos) SaveFileB(bucket, path string, bytes []byte, opts vba
 		}
 		entry := &vbaseEntry{
 			value:       bytes,
-			eTag:        genEtag(),
+			eTag:        vbase.ContentHash(bytes),
 			contentType: opts.ContentType,
 		}
 		buck.entries[path] = entry
@@ -77,7 +77,7 @@ func (r *fakeVbaseChronos) SaveFileB(bucket, path string, bytes []byte, opts vba
 		fullPath := filepath.Join(path, filePath)
 		buck.entries[fullPath] = &vbaseEntry{
 			value:       content,
-			eTag:        genEtag(),
+			eTag:        vbase.ContentHash(content),
 			contentType: "text/plain",
 		}
 	}
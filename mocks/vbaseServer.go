@@ -0,0 +1,217 @@
+package mocks
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/vbase"
+)
+
+// NewVBaseHandler returns an http.Handler emulating the VBase file and
+// resumable upload endpoints on top of a fake created by NewVBase. Point a
+// VBase client to it through clients.Config.Endpoint, e.g. using
+// httptest.NewServer.
+func NewVBaseHandler(backend vbase.VBase) http.Handler {
+	return &vbaseHandler{
+		fake:     backend.(*fakeVbase),
+		sessions: map[string]*uploadSession{},
+	}
+}
+
+type uploadSession struct {
+	vbase.UploadSession
+	bucket  string
+	content []byte
+}
+
+type vbaseHandler struct {
+	fake *fakeVbase
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+	lastID   int
+}
+
+func (s *vbaseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	idx := strings.Index(r.URL.Path, "/buckets/")
+	if idx < 0 {
+		writeError(w, http.StatusNotFound, "not_found", "Unknown path")
+		return
+	}
+	// app, bucket, kind, rest
+	parts := strings.SplitN(r.URL.Path[idx+len("/buckets/"):], "/", 4)
+	for len(parts) < 4 {
+		parts = append(parts, "")
+	}
+	bucket, kind, rest := parts[1], parts[2], parts[3]
+
+	switch {
+	case kind == "files" && r.Method == http.MethodGet:
+		s.getFile(w, r, bucket, rest)
+	case kind == "files" && r.Method == http.MethodPut:
+		s.saveFile(w, r, bucket, rest)
+	case kind == "files" && r.Method == http.MethodDelete:
+		if err := s.fake.DeleteFile(bucket, rest); err != nil {
+			writeError(w, http.StatusNotFound, "not_found", "File not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case kind == "uploads" && rest == "" && r.Method == http.MethodPost:
+		s.createSession(w, r, bucket)
+	case kind == "uploads" && r.Method == http.MethodGet:
+		s.withSession(w, rest, func(session *uploadSession) {
+			writeJSON(w, session.UploadSession)
+		})
+	case kind == "uploads" && r.Method == http.MethodPut:
+		s.withSession(w, rest, func(session *uploadSession) {
+			s.appendChunk(w, r, session)
+		})
+	case kind == "uploads" && strings.HasSuffix(rest, "/complete") && r.Method == http.MethodPost:
+		s.withSession(w, strings.TrimSuffix(rest, "/complete"), func(session *uploadSession) {
+			s.completeSession(w, session)
+		})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Unsupported operation")
+	}
+}
+
+func (s *vbaseHandler) getFile(w http.ResponseWriter, r *http.Request, bucket, path string) {
+	s.fake.Lock()
+	_, entry, ok := s.fake.getEntry(bucket, path)
+	s.fake.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "File not found")
+		return
+	}
+
+	w.Header().Set(vbase.HeaderContentType, entry.contentType)
+	w.Header().Set(clients.HeaderETag, entry.eTag)
+	content := entry.value
+
+	var start, end int64
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+		w.Write(content)
+		return
+	}
+	if start >= int64(len(content)) || end < start {
+		writeError(w, http.StatusRequestedRangeNotSatisfiable, "invalid_range", "Invalid range")
+		return
+	}
+	if end >= int64(len(content)) {
+		end = int64(len(content)) - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(content[start : end+1])
+}
+
+func (s *vbaseHandler) saveFile(w http.ResponseWriter, r *http.Request, bucket, path string) {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if digest := r.Header.Get("Content-MD5"); digest != "" {
+		sum := md5.Sum(content)
+		if digest != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "bad_digest", "Content-MD5 doesn't match the body")
+			return
+		}
+	}
+	unzip, _ := strconv.ParseBool(r.URL.Query().Get("unzip"))
+	eTag, err := s.fake.SaveFileB(bucket, path, content, vbase.SaveFileOptions{
+		ContentType: r.Header.Get(vbase.HeaderContentType),
+		Unzip:       unzip,
+		IfMatch:     r.Header.Get("If-Match"),
+		IfNoneMatch: r.Header.Get("If-None-Match"),
+	})
+	if vbase.IsPreconditionFailed(err) {
+		writeError(w, http.StatusPreconditionFailed, "precondition_failed", "File ETag doesn't match")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	w.Header().Set(clients.HeaderETag, eTag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *vbaseHandler) createSession(w http.ResponseWriter, r *http.Request, bucket string) {
+	session := &uploadSession{bucket: bucket}
+	if err := json.NewDecoder(r.Body).Decode(&session.UploadSession); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.lastID++
+	session.ID = fmt.Sprintf("upload-%d", s.lastID)
+	session.Offset = 0
+	s.sessions[session.ID] = session
+	s.mu.Unlock()
+
+	writeJSON(w, session.UploadSession)
+}
+
+func (s *vbaseHandler) withSession(w http.ResponseWriter, id string, fn func(session *uploadSession)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Upload session not found")
+		return
+	}
+	fn(session)
+}
+
+func (s *vbaseHandler) appendChunk(w http.ResponseWriter, r *http.Request, session *uploadSession) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset != session.Offset {
+		writeError(w, http.StatusBadRequest, "invalid_offset", fmt.Sprintf("Expected offset %d", session.Offset))
+		return
+	}
+	chunk, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	session.content = append(session.content, chunk...)
+	session.Offset += int64(len(chunk))
+	writeJSON(w, session.UploadSession)
+}
+
+func (s *vbaseHandler) completeSession(w http.ResponseWriter, session *uploadSession) {
+	eTag, err := s.fake.SaveFileB(session.bucket, session.Path, session.content, vbase.SaveFileOptions{
+		ContentType: session.ContentType,
+		Unzip:       session.Unzip,
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	delete(s.sessions, session.ID)
+
+	w.Header().Set(clients.HeaderETag, eTag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set(vbase.HeaderContentType, "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set(vbase.HeaderContentType, "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(clients.ErrorDescriptor{Code: code, Message: message})
+}
@@ -0,0 +1,112 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ValidationError is returned when a document doesn't match the schema
+// registered for its location
+type ValidationError struct {
+	Bucket string
+	Path   string
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		msgs[i] = fieldErr.String()
+	}
+	return fmt.Sprintf("Document %s/%s doesn't match its schema: %s", e.Bucket, e.Path, strings.Join(msgs, "; "))
+}
+
+type registration struct {
+	bucket  string
+	pattern string
+	schema  *Schema
+}
+
+// Registry holds the schemas of documents by bucket and path pattern. It is
+// safe for concurrent use.
+type Registry struct {
+	mu            sync.RWMutex
+	registrations []registration
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register sets the schema of documents in bucket whose path matches pattern,
+// as in path.Match. When several patterns match a path, the first registered
+// one is used.
+func (r *Registry) Register(bucket, pattern string, s *Schema) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Invalid schema pattern %q: %v", pattern, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registrations = append(r.registrations, registration{bucket, pattern, s})
+	return nil
+}
+
+// Lookup returns the schema of a document, or nil if there is none
+func (r *Registry) Lookup(bucket, docPath string) *Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, reg := range r.registrations {
+		if reg.bucket != bucket {
+			continue
+		}
+		if ok, _ := path.Match(reg.pattern, docPath); ok {
+			return reg.schema
+		}
+	}
+	return nil
+}
+
+// Validate checks data, which is serialized to JSON, against the schema of its
+// location, returning a *ValidationError if it doesn't match. Documents
+// without a schema are valid. A nil Registry has no schemas.
+func (r *Registry) Validate(bucket, docPath string, data interface{}) error {
+	if r == nil {
+		return nil
+	}
+	s := r.Lookup(bucket, docPath)
+	if s == nil {
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return validateRaw(s, bucket, docPath, raw)
+}
+
+// ValidateJSON is like Validate for an already serialized document
+func (r *Registry) ValidateJSON(bucket, docPath string, raw []byte) error {
+	if r == nil {
+		return nil
+	}
+	s := r.Lookup(bucket, docPath)
+	if s == nil {
+		return nil
+	}
+	return validateRaw(s, bucket, docPath, raw)
+}
+
+func validateRaw(s *Schema, bucket, docPath string, raw []byte) error {
+	errs, err := s.ValidateJSON(raw)
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Bucket: bucket, Path: docPath, Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+// Package schema validates JSON documents stored in VBase and Metadata against
+// JSON Schemas registered by bucket and path pattern.
+//
+// Only the validation keywords most used to describe stored documents are
+// supported: type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, uniqueItems, minLength, maxLength, pattern,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, allOf,
+// anyOf, oneOf and not, along with annotations such as title and
+// description. Compile fails on any other keyword, including $ref and format,
+// rather than accepting documents it can't check.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema
+type Schema struct {
+	types                []string
+	enum                 []interface{}
+	constant             *interface{}
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	noAdditional         bool
+	items                *Schema
+	minItems, maxItems   *int
+	uniqueItems          bool
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	minimum, maximum     *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	multipleOf           *float64
+	allOf, anyOf, oneOf  []*Schema
+	not                  *Schema
+}
+
+type schemaDoc struct {
+	Type                 json.RawMessage            `json:"type"`
+	Enum                 []interface{}              `json:"enum"`
+	Const                *json.RawMessage           `json:"const"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	UniqueItems          bool                       `json:"uniqueItems"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              string                     `json:"pattern"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	ExclusiveMinimum     *float64                   `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64                   `json:"exclusiveMaximum"`
+	MultipleOf           *float64                   `json:"multipleOf"`
+	AllOf                []json.RawMessage          `json:"allOf"`
+	AnyOf                []json.RawMessage          `json:"anyOf"`
+	OneOf                []json.RawMessage          `json:"oneOf"`
+	Not                  json.RawMessage            `json:"not"`
+}
+
+// supportedKeywords are the keywords of schemaDoc, and annotations, which
+// don't affect validation
+var supportedKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "properties": true, "required": true,
+	"additionalProperties": true, "items": true, "minItems": true, "maxItems": true,
+	"uniqueItems": true, "minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+	"multipleOf": true, "allOf": true, "anyOf": true, "oneOf": true, "not": true,
+
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "readOnly": true, "writeOnly": true, "deprecated": true,
+}
+
+// Compile parses a JSON Schema
+func Compile(raw []byte) (*Schema, error) {
+	return compile(raw, "")
+}
+
+// MustCompile is like Compile but panics if the schema is invalid. It is
+// meant for schemas defined in code.
+func MustCompile(raw string) *Schema {
+	s, err := Compile([]byte(raw))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func compile(raw []byte, pointer string) (*Schema, error) {
+	// The true schema accepts everything, and false rejects everything
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		if b {
+			return &Schema{}, nil
+		}
+		return &Schema{not: &Schema{}}, nil
+	}
+
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &keywords); err != nil {
+		return nil, fmt.Errorf("Invalid schema at %q: %v", pointer, err)
+	}
+	var unsupported []string
+	for keyword := range keywords {
+		if !supportedKeywords[keyword] {
+			unsupported = append(unsupported, keyword)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return nil, fmt.Errorf("Unsupported keyword(s) at %q: %s", pointer, strings.Join(unsupported, ", "))
+	}
+
+	var doc schemaDoc
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("Invalid schema at %q: %v", pointer, err)
+	}
+
+	s := &Schema{
+		enum:             doc.Enum,
+		required:         doc.Required,
+		minItems:         doc.MinItems,
+		maxItems:         doc.MaxItems,
+		uniqueItems:      doc.UniqueItems,
+		minLength:        doc.MinLength,
+		maxLength:        doc.MaxLength,
+		minimum:          doc.Minimum,
+		maximum:          doc.Maximum,
+		exclusiveMinimum: doc.ExclusiveMinimum,
+		exclusiveMaximum: doc.ExclusiveMaximum,
+		multipleOf:       doc.MultipleOf,
+	}
+
+	if len(doc.Type) > 0 {
+		if err := json.Unmarshal(doc.Type, &s.types); err != nil {
+			var single string
+			if err := json.Unmarshal(doc.Type, &single); err != nil {
+				return nil, fmt.Errorf("Invalid type at %q", pointer)
+			}
+			s.types = []string{single}
+		}
+	}
+	if doc.Const != nil {
+		var c interface{}
+		if err := json.Unmarshal(*doc.Const, &c); err != nil {
+			return nil, fmt.Errorf("Invalid const at %q: %v", pointer, err)
+		}
+		s.constant = &c
+	}
+	if doc.Pattern != "" {
+		re, err := regexp.Compile(doc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern at %q: %v", pointer, err)
+		}
+		s.pattern = re
+	}
+
+	var err error
+	if len(doc.Properties) > 0 {
+		s.properties = map[string]*Schema{}
+		for name, sub := range doc.Properties {
+			if s.properties[name], err = compile(sub, pointer+"/properties/"+escape(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(doc.AdditionalProperties) > 0 {
+		var allowed bool
+		if json.Unmarshal(doc.AdditionalProperties, &allowed) == nil {
+			s.noAdditional = !allowed
+		} else if s.additionalProperties, err = compile(doc.AdditionalProperties, pointer+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if len(doc.Items) > 0 {
+		if s.items, err = compile(doc.Items, pointer+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	if len(doc.Not) > 0 {
+		if s.not, err = compile(doc.Not, pointer+"/not"); err != nil {
+			return nil, err
+		}
+	}
+	if s.allOf, err = compileAll(doc.AllOf, pointer+"/allOf"); err != nil {
+		return nil, err
+	}
+	if s.anyOf, err = compileAll(doc.AnyOf, pointer+"/anyOf"); err != nil {
+		return nil, err
+	}
+	if s.oneOf, err = compileAll(doc.OneOf, pointer+"/oneOf"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func compileAll(raws []json.RawMessage, pointer string) ([]*Schema, error) {
+	schemas := make([]*Schema, len(raws))
+	for i, raw := range raws {
+		var err error
+		if schemas[i], err = compile(raw, fmt.Sprintf("%s/%d", pointer, i)); err != nil {
+			return nil, err
+		}
+	}
+	return schemas, nil
+}
+
+// FieldError is a validation failure of the value at a JSON Pointer
+type FieldError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	if e.Pointer == "" {
+		return e.Message
+	}
+	return e.Pointer + ": " + e.Message
+}
+
+// Validate checks a document decoded from JSON, i.e. made of maps, slices,
+// strings, float64s, bools and nils, returning every failure found.
+func (s *Schema) Validate(doc interface{}) []FieldError {
+	var errs []FieldError
+	s.validate(doc, "", &errs)
+	return errs
+}
+
+// ValidateJSON decodes and validates a JSON document
+func (s *Schema) ValidateJSON(raw []byte) ([]FieldError, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return s.Validate(doc), nil
+}
+
+func (s *Schema) validate(v interface{}, pointer string, errs *[]FieldError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{pointer, fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.types) > 0 && !matchesType(v, s.types) {
+		fail("must be of type %s", strings.Join(s.types, " or "))
+		return
+	}
+	if s.enum != nil && !containsValue(s.enum, v) {
+		fail("must be one of the allowed values")
+	}
+	if s.constant != nil && !reflect.DeepEqual(*s.constant, v) {
+		fail("must be equal to the constant value")
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		s.validateObject(v, pointer, errs)
+	case []interface{}:
+		s.validateArray(v, pointer, errs)
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			fail("must have at least %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("must have at most %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match pattern %s", s.pattern)
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			fail("must be greater than or equal to %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("must be less than or equal to %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			fail("must be greater than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			fail("must be less than %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil && *s.multipleOf != 0 {
+			if q := v / *s.multipleOf; q != math.Trunc(q) {
+				fail("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, pointer, errs)
+	}
+	if len(s.anyOf) > 0 && countValid(s.anyOf, v) == 0 {
+		fail("must match at least one of the allowed schemas")
+	}
+	if len(s.oneOf) > 0 && countValid(s.oneOf, v) != 1 {
+		fail("must match exactly one of the allowed schemas")
+	}
+	if s.not != nil && len(s.not.Validate(v)) == 0 {
+		fail("must not match the disallowed schema")
+	}
+}
+
+func (s *Schema) validateObject(v map[string]interface{}, pointer string, errs *[]FieldError) {
+	for _, name := range s.required {
+		if _, ok := v[name]; !ok {
+			*errs = append(*errs, FieldError{pointer + "/" + escape(name), "is required"})
+		}
+	}
+
+	// Sorted so that errors are reported in a stable order
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := pointer + "/" + escape(name)
+		if sub, ok := s.properties[name]; ok {
+			sub.validate(v[name], child, errs)
+		} else if s.noAdditional {
+			*errs = append(*errs, FieldError{child, "is not allowed"})
+		} else if s.additionalProperties != nil {
+			s.additionalProperties.validate(v[name], child, errs)
+		}
+	}
+}
+
+func (s *Schema) validateArray(v []interface{}, pointer string, errs *[]FieldError) {
+	if s.minItems != nil && len(v) < *s.minItems {
+		*errs = append(*errs, FieldError{pointer, fmt.Sprintf("must have at least %d items", *s.minItems)})
+	}
+	if s.maxItems != nil && len(v) > *s.maxItems {
+		*errs = append(*errs, FieldError{pointer, fmt.Sprintf("must have at most %d items", *s.maxItems)})
+	}
+	if s.uniqueItems {
+		for i := range v {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(v[i], v[j]) {
+					*errs = append(*errs, FieldError{fmt.Sprintf("%s/%d", pointer, i), fmt.Sprintf("duplicates item %d", j)})
+					break
+				}
+			}
+		}
+	}
+	if s.items != nil {
+		for i, item := range v {
+			s.items.validate(item, fmt.Sprintf("%s/%d", pointer, i), errs)
+		}
+	}
+}
+
+func matchesType(v interface{}, types []string) bool {
+	for _, t := range types {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, value := range values {
+		if reflect.DeepEqual(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func countValid(schemas []*Schema, v interface{}) int {
+	count := 0
+	for _, s := range schemas {
+		if len(s.Validate(v)) == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// escape encodes a property name as a JSON Pointer reference token
+func escape(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,374 @@
+// Package archive exports VBase buckets to tar.gz or zip archives and imports
+// them back.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vtex/go-clients/vbase"
+)
+
+// Format is the archive format used by Export
+type Format string
+
+const (
+	FormatTarGz = Format("tar.gz")
+	FormatZip   = Format("zip")
+)
+
+// ManifestName is the name of the archive entry holding the Manifest. It is
+// always the last entry of an exported archive.
+const ManifestName = ".vbase-manifest.json"
+
+// paxContentType is the PAX record holding an entry's content type in tar
+// archives, so that imports can stream entries before reading the manifest.
+const paxContentType = "VTEX.vbase.contentType"
+
+// Manifest describes the files in an exported archive
+type Manifest struct {
+	Bucket     string           `json:"bucket"`
+	Prefix     string           `json:"prefix"`
+	ExportedAt time.Time        `json:"exportedAt"`
+	Files      []*ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes a single exported file. Hash is the hash reported
+// by VBase when the file was exported.
+type ManifestEntry struct {
+	Path        string `json:"path"`
+	ContentType string `json:"contentType"`
+	Hash        string `json:"hash"`
+}
+
+// ImportOptions configures Import
+type ImportOptions struct {
+	// Unzip uploads zip archives in a single request, letting VBase extract
+	// them. Content types are not preserved in this mode.
+	Unzip bool
+	// SkipVerify skips comparing the imported files' hashes with the manifest.
+	SkipVerify bool
+}
+
+// Export writes every file in bucket under prefix to w. Files are streamed as
+// stored, e.g. still compressed, with the content type they were saved with,
+// and checked against the MD5 hash reported in the bucket listing.
+func Export(client vbase.VBase, bucket, prefix string, w io.Writer, format Format) error {
+	var aw archiveWriter
+	switch format {
+	case FormatTarGz:
+		aw = newTarGzWriter(w)
+	case FormatZip:
+		aw = &zipWriter{zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("Unknown archive format: %s", format)
+	}
+
+	list, _, err := client.ListAllFiles(bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	manifest := &Manifest{Bucket: bucket, Prefix: prefix, ExportedAt: time.Now().UTC()}
+	for _, f := range list.Files {
+		contentType, err := exportFile(client, aw, bucket, f)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, &ManifestEntry{Path: f.Path, ContentType: contentType, Hash: f.Hash})
+	}
+
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := aw.WriteFile(ManifestName, "application/json", int64(len(buf)), bytes.NewReader(buf)); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// Import uploads every file in an archive created by Export to bucket. The
+// archive format is detected from its content. Tar archives are streamed
+// entry by entry, while zip archives are spooled to a temporary file since
+// they need random access.
+func Import(client vbase.VBase, r io.Reader, bucket string, opts ImportOptions) (*Manifest, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading archive header: %v", err)
+	}
+
+	var manifest *Manifest
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		manifest, err = importTarGz(client, br, bucket)
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		manifest, err = importZip(client, br, bucket, opts.Unzip)
+	default:
+		return nil, fmt.Errorf("Unknown archive format")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.SkipVerify {
+		if err := verify(client, bucket, manifest); err != nil {
+			return manifest, err
+		}
+	}
+	return manifest, nil
+}
+
+func importTarGz(client vbase.VBase, r io.Reader, bucket string) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var manifest *Manifest
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if hdr.Name == ManifestName {
+			if manifest, err = decodeManifest(tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		_, err = client.SaveFile(bucket, hdr.Name, tr, vbase.SaveFileOptions{
+			ContentType: hdr.PAXRecords[paxContentType],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error importing %s: %v", hdr.Name, err)
+		}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("Archive has no %s", ManifestName)
+	}
+	return manifest, nil
+}
+
+func importZip(client vbase.VBase, r io.Reader, bucket string, unzip bool) (*Manifest, error) {
+	tmp, err := ioutil.TempFile("", "vbase-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest *Manifest
+	for _, f := range zr.File {
+		if f.Name == ManifestName {
+			if manifest, err = decodeZipManifest(f); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("Archive has no %s", ManifestName)
+	}
+
+	if unzip {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := client.SaveFile(bucket, "", tmp, vbase.SaveFileOptions{Unzip: true}); err != nil {
+			return nil, err
+		}
+		return manifest, client.DeleteFile(bucket, ManifestName)
+	}
+
+	contentTypes := make(map[string]string, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		contentTypes[entry.Path] = entry.ContentType
+	}
+	for _, f := range zr.File {
+		if f.Name == ManifestName || f.FileInfo().IsDir() {
+			continue
+		}
+		if err := saveZipEntry(client, bucket, f, contentTypes[f.Name]); err != nil {
+			return nil, fmt.Errorf("Error importing %s: %v", f.Name, err)
+		}
+	}
+	return manifest, nil
+}
+
+func saveZipEntry(client vbase.VBase, bucket string, f *zip.File, contentType string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = client.SaveFile(bucket, f.Name, rc, vbase.SaveFileOptions{ContentType: contentType})
+	return err
+}
+
+func decodeZipManifest(f *zip.File) (*Manifest, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return decodeManifest(rc)
+}
+
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("Error decoding %s: %v", ManifestName, err)
+	}
+	return &manifest, nil
+}
+
+// verify compares the hashes of the imported files with the ones recorded in
+// the manifest.
+func verify(client vbase.VBase, bucket string, manifest *Manifest) error {
+	list, _, err := client.ListAllFiles(bucket, manifest.Prefix)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]string, len(list.Files))
+	for _, f := range list.Files {
+		hashes[f.Path] = f.Hash
+	}
+
+	var mismatches []string
+	for _, entry := range manifest.Files {
+		if hash, ok := hashes[entry.Path]; !ok {
+			mismatches = append(mismatches, entry.Path+" (missing)")
+		} else if hash != entry.Hash {
+			mismatches = append(mismatches, entry.Path)
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("Imported files differ from manifest in bucket %s: %s", bucket, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// exportFile writes a file to the archive as stored, returning its content
+// type. The content is hashed while written, so a mismatch is only detected
+// after the entry is written.
+func exportFile(client vbase.VBase, aw archiveWriter, bucket string, f *vbase.FileEntryResponse) (string, error) {
+	file, err := vbase.GetFileRaw(client, bucket, f.Path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var body io.Reader = file
+	size := file.Length
+	if size < 0 {
+		// Tar entries need their size upfront
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			return "", err
+		}
+		body, size = bytes.NewReader(content), int64(len(content))
+	}
+
+	h := md5.New()
+	if err := aw.WriteFile(f.Path, file.ContentType, size, io.TeeReader(body, h)); err != nil {
+		return "", fmt.Errorf("Error exporting %s: %v", f.Path, err)
+	}
+	if hash := hex.EncodeToString(h.Sum(nil)); hash != f.Hash {
+		return "", fmt.Errorf("Hash mismatch exporting %s: expected %s, got %s", f.Path, f.Hash, hash)
+	}
+	return file.ContentType, nil
+}
+
+// archiveWriter writes entries of size bytes read from r
+type archiveWriter interface {
+	WriteFile(name, contentType string, size int64, r io.Reader) error
+	Close() error
+}
+
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarGzWriter(w io.Writer) *tarGzWriter {
+	gz := gzip.NewWriter(w)
+	return &tarGzWriter{gz, tar.NewWriter(gz)}
+}
+
+func (w *tarGzWriter) WriteFile(name, contentType string, size int64, r io.Reader) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Mode:       0644,
+		Size:       size,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{paxContentType: contentType},
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w.tw, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("Read %d bytes, expected %d", n, size)
+	}
+	return err
+}
+
+func (w *tarGzWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) WriteFile(name, contentType string, size int64, r io.Reader) error {
+	fw, err := w.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
@@ -0,0 +1,95 @@
+package vbase
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vtex/go-clients/clients"
+)
+
+// BatchError reports the paths that failed in a batch operation
+type BatchError struct {
+	Bucket string
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	paths := make([]string, 0, len(e.Errors))
+	for path := range e.Errors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	msgs := make([]string, len(paths))
+	for i, path := range paths {
+		msgs[i] = fmt.Sprintf("%s: %v", path, e.Errors[path])
+	}
+	return fmt.Sprintf("Error(s) in %d files of bucket %s: %s", len(paths), e.Bucket, strings.Join(msgs, "; "))
+}
+
+// DeleteMany deletes the specified files from a bucket. Conflicts are handled
+// by the first delete only, the remaining ones run concurrently afterwards.
+// Failures are reported in a *BatchError.
+func (cl *client) DeleteMany(bucket string, paths []string, opts DeleteOptions) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+
+	batchErr := &BatchError{Bucket: bucket, Errors: map[string]error{}}
+	failed := func(err error) bool {
+		return err != nil && !(opts.IgnoreNotFound && clients.IsNotFound(err))
+	}
+
+	if err := cl.DeleteFile(bucket, paths[0]); failed(err) {
+		batchErr.Errors[paths[0]] = err
+	}
+
+	clNoConflicts := *cl
+	clNoConflicts.resolvingConflicts = true
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	sem := make(chan struct{}, opts.Concurrency)
+	for _, path := range paths[1:] {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(path string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := clNoConflicts.DeleteFile(bucket, path); failed(err) {
+				mu.Lock()
+				batchErr.Errors[path] = err
+				mu.Unlock()
+			}
+		}(path)
+	}
+	wg.Wait()
+
+	if len(batchErr.Errors) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+// DeletePrefix deletes every file under prefix from a bucket
+func (cl *client) DeletePrefix(bucket, prefix string, opts DeleteOptions) error {
+	list, _, err := cl.ListAllFiles(bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, len(list.Files))
+	for i, f := range list.Files {
+		paths[i] = f.Path
+	}
+	return cl.DeleteMany(bucket, paths, opts)
+}
@@ -0,0 +1,34 @@
+package vbase
+
+import (
+	"context"
+	"time"
+
+	"github.com/vtex/go-clients/common"
+)
+
+// WaitForBucketState polls a bucket until it reaches state or ctx is done.
+// Polls start every half second and back off up to every ten seconds.
+func WaitForBucketState(ctx context.Context, client VBase, bucket string, state common.BucketState) error {
+	interval := 500 * time.Millisecond
+	for {
+		res, _, err := client.GetBucket(bucket)
+		if err != nil {
+			return err
+		}
+		if res.State == state {
+			return nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if interval *= 2; interval > 10*time.Second {
+			interval = 10 * time.Second
+		}
+	}
+}
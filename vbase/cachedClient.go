@@ -0,0 +1,475 @@
+package vbase
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vtex/go-clients/common"
+)
+
+// CacheOptions configures a CachedClient
+type CacheOptions struct {
+	// MaxBytes bounds the total size of cached file contents. Defaults to 64MB.
+	MaxBytes int64
+	// TTL is how long a cached file is served without revalidation. Defaults
+	// to one minute.
+	TTL time.Duration
+	// BucketTTL overrides TTL for specific buckets
+	BucketTTL map[string]time.Duration
+	// BucketHashInterval, if positive, is how often the bucket hash is checked
+	// to drop every cached file of a bucket as soon as it changes.
+	BucketHashInterval time.Duration
+}
+
+// CacheStats counts how reads were served by a CachedClient
+type CacheStats struct {
+	Hits          int64
+	Misses        int64
+	Revalidations int64
+	Evictions     int64
+}
+
+// CachedClient is a VBase decorator keeping recently read files in memory.
+// Expired files are revalidated by ETag when the inner client implements
+// ConditionalGetter. Concurrent misses of a same file share a single request.
+// CachedClient implements ConditionalGetter, ConditionalDeleter and RawGetter,
+// falling back to the VBase methods for inner clients that don't. Writes made through the decorator invalidate the files
+// they touch, but writes made by other clients are only seen after the TTL
+// expires or the bucket hash changes.
+type CachedClient struct {
+	inner VBase
+	opts  CacheOptions
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+	size    int64
+	buckets map[string]*cachedBucket
+	stats   CacheStats
+	// generation is bumped by every invalidation, so that files fetched
+	// before one aren't cached after it
+	generation uint64
+
+	fetches      flightGroup[fetchKey, *fetchResult]
+	bucketChecks flightGroup[string, struct{}]
+}
+
+// fetchKey identifies the concurrent fetches of a file that can share a
+// request: fetches started after an invalidation don't share earlier ones
+type fetchKey struct {
+	cacheKey
+	needETag   bool
+	generation uint64
+}
+
+type fetchResult struct {
+	entry       *cacheEntry
+	revalidated bool
+}
+
+type cacheKey struct {
+	bucket string
+	path   string
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	content     []byte
+	contentType string
+	eTag        string
+	expires     time.Time
+}
+
+type cachedBucket struct {
+	hash      string
+	checkedAt time.Time
+}
+
+// NewCachedClient wraps inner with an in-process read-through cache
+func NewCachedClient(inner VBase, opts CacheOptions) *CachedClient {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Minute
+	}
+	return &CachedClient{
+		inner:   inner,
+		opts:    opts,
+		lru:     list.New(),
+		entries: map[cacheKey]*list.Element{},
+		buckets: map[string]*cachedBucket{},
+	}
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *CachedClient) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// GetFile gets a file's content, from the cache if possible
+func (c *CachedClient) GetFile(bucket, path string) (io.ReadCloser, string, error) {
+	entry, err := c.get(bucket, path, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return ioutil.NopCloser(bytes.NewReader(entry.content)), entry.contentType, nil
+}
+
+// GetJSON populates data with the content of the specified file, from the
+// cache if possible
+func (c *CachedClient) GetJSON(bucket, path string, data interface{}) (string, error) {
+	entry, err := c.get(bucket, path, true)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(entry.content, data); err != nil {
+		return "", err
+	}
+	return entry.eTag, nil
+}
+
+// GetFileIfNoneMatch gets a file's content, from the cache if possible,
+// returning a nil file if its ETag is still eTag. ETags are only known for
+// files read from inner clients implementing ConditionalGetter or with GetJSON.
+func (c *CachedClient) GetFileIfNoneMatch(bucket, path, eTag string) (io.ReadCloser, string, string, error) {
+	_, conditional := c.inner.(ConditionalGetter)
+	entry, err := c.get(bucket, path, conditional)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if eTag != "" && entry.eTag == eTag {
+		return nil, "", eTag, nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(entry.content)), entry.contentType, entry.eTag, nil
+}
+
+// GetFileRaw reads a file as stored, bypassing the cache, whose contents are
+// decoded
+func (c *CachedClient) GetFileRaw(bucket, path string) (*FileRange, error) {
+	return GetFileRaw(c.inner, bucket, path)
+}
+
+func (c *CachedClient) GetFileRange(bucket, path string, offset, length int64) (*FileRange, error) {
+	return c.inner.GetFileRange(bucket, path, offset, length)
+}
+
+func (c *CachedClient) Download(ctx context.Context, bucket, path string, w io.WriterAt, opts DownloadOptions) error {
+	return c.inner.Download(ctx, bucket, path, w, opts)
+}
+
+func (c *CachedClient) ListFiles(bucket string, options *Options) (*FileListResponse, string, error) {
+	return c.inner.ListFiles(bucket, options)
+}
+
+func (c *CachedClient) ListAllFiles(bucket, prefix string) (*FileListResponse, string, error) {
+	return c.inner.ListAllFiles(bucket, prefix)
+}
+
+func (c *CachedClient) SaveFile(bucket, path string, body io.Reader, opts SaveFileOptions) (string, error) {
+	defer c.invalidateWrite(bucket, path, opts)
+	return c.inner.SaveFile(bucket, path, body, opts)
+}
+
+func (c *CachedClient) SaveFileB(bucket, path string, content []byte, opts SaveFileOptions) (string, error) {
+	defer c.invalidateWrite(bucket, path, opts)
+	return c.inner.SaveFileB(bucket, path, content, opts)
+}
+
+func (c *CachedClient) Upload(ctx context.Context, bucket, path string, body io.Reader, opts UploadOptions) (string, error) {
+	defer c.invalidateWrite(bucket, path, opts.SaveFileOptions)
+	return c.inner.Upload(ctx, bucket, path, body, opts)
+}
+
+func (c *CachedClient) SaveJSON(bucket, path string, data interface{}) (string, error) {
+	defer c.invalidate(bucket, path)
+	return c.inner.SaveJSON(bucket, path, data)
+}
+
+func (c *CachedClient) DeleteFile(bucket, path string) error {
+	defer c.invalidate(bucket, path)
+	return c.inner.DeleteFile(bucket, path)
+}
+
+// DeleteFileIfMatch deletes a file unless its ETag changed. Inner clients that
+// aren't ConditionalDeleters delete it unconditionally.
+func (c *CachedClient) DeleteFileIfMatch(bucket, path, eTag string) error {
+	defer c.invalidate(bucket, path)
+	if deleter, ok := c.inner.(ConditionalDeleter); ok {
+		return deleter.DeleteFileIfMatch(bucket, path, eTag)
+	}
+	return c.inner.DeleteFile(bucket, path)
+}
+
+func (c *CachedClient) DeleteMany(bucket string, paths []string, opts DeleteOptions) error {
+	defer func() {
+		for _, path := range paths {
+			c.invalidate(bucket, path)
+		}
+	}()
+	return c.inner.DeleteMany(bucket, paths, opts)
+}
+
+func (c *CachedClient) DeletePrefix(bucket, prefix string, opts DeleteOptions) error {
+	defer c.invalidatePrefix(bucket, prefix)
+	return c.inner.DeletePrefix(bucket, prefix, opts)
+}
+
+func (c *CachedClient) DeleteAllFiles(bucket string) error {
+	defer c.invalidateBucket(bucket)
+	return c.inner.DeleteAllFiles(bucket)
+}
+
+func (c *CachedClient) GetBucket(bucket string) (*BucketResponse, string, error) {
+	return c.inner.GetBucket(bucket)
+}
+
+func (c *CachedClient) SetBucketState(bucket string, state common.BucketState) error {
+	return c.inner.SetBucketState(bucket, state)
+}
+
+func (c *CachedClient) ListBuckets(appName string) ([]*BucketResponse, error) {
+	return c.inner.ListBuckets(appName)
+}
+
+func (c *CachedClient) ListAllConflicts(bucket string) ([]*Conflict, error) {
+	return c.inner.ListAllConflicts(bucket)
+}
+
+func (c *CachedClient) ResolveConflicts(bucket string, patch PatchRequest) error {
+	defer c.invalidateBucket(bucket)
+	return c.inner.ResolveConflicts(bucket, patch)
+}
+
+// get returns a fresh cache entry for the file, downloading or revalidating it
+// if needed. If needETag is set, entries cached without an ETag are refetched.
+// Entries fetched while the cache was invalidated are returned but not stored.
+func (c *CachedClient) get(bucket, path string, needETag bool) (*cacheEntry, error) {
+	c.checkBucketHash(bucket)
+
+	key := cacheKey{bucket, path}
+	c.mu.Lock()
+	generation := c.generation
+	var cached *cacheEntry
+	if el, ok := c.entries[key]; ok {
+		cached = el.Value.(*cacheEntry)
+		if time.Now().Before(cached.expires) && (!needETag || cached.eTag != "") {
+			c.lru.MoveToFront(el)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return cached, nil
+		}
+	}
+	c.mu.Unlock()
+
+	res, err := c.fetches.do(fetchKey{key, needETag, generation}, func() (*fetchResult, error) {
+		entry, revalidated, err := c.fetch(key, cached, needETag)
+		if err != nil {
+			return nil, err
+		}
+		return &fetchResult{entry, revalidated}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if res.revalidated {
+		c.stats.Revalidations++
+	} else {
+		c.stats.Misses++
+	}
+	if c.generation == generation {
+		c.store(res.entry)
+	}
+	return res.entry, nil
+}
+
+func (c *CachedClient) fetch(key cacheKey, cached *cacheEntry, needETag bool) (*cacheEntry, bool, error) {
+	entry := &cacheEntry{key: key, expires: time.Now().Add(c.ttl(key.bucket))}
+
+	if getter, ok := c.inner.(ConditionalGetter); ok {
+		var eTag string
+		if cached != nil {
+			eTag = cached.eTag
+		}
+		file, contentType, newETag, err := getter.GetFileIfNoneMatch(key.bucket, key.path, eTag)
+		if err != nil {
+			return nil, false, err
+		}
+		if file == nil && cached != nil {
+			entry.content, entry.contentType, entry.eTag = cached.content, cached.contentType, newETag
+			return entry, true, nil
+		}
+		defer file.Close()
+		entry.contentType, entry.eTag = contentType, newETag
+		entry.content, err = ioutil.ReadAll(file)
+		return entry, false, err
+	}
+
+	if needETag {
+		var raw json.RawMessage
+		eTag, err := c.inner.GetJSON(key.bucket, key.path, &raw)
+		if err != nil {
+			return nil, false, err
+		}
+		entry.content, entry.contentType, entry.eTag = raw, "application/json", eTag
+		return entry, false, nil
+	}
+
+	file, contentType, err := c.inner.GetFile(key.bucket, key.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	entry.contentType = contentType
+	entry.content, err = ioutil.ReadAll(file)
+	return entry, false, err
+}
+
+func (c *CachedClient) ttl(bucket string) time.Duration {
+	if ttl, ok := c.opts.BucketTTL[bucket]; ok {
+		return ttl
+	}
+	return c.opts.TTL
+}
+
+// store adds an entry to the cache, evicting the least recently used ones to
+// stay under MaxBytes. Must be called with the lock held.
+func (c *CachedClient) store(entry *cacheEntry) {
+	c.removeNoLock(entry.key)
+
+	size := int64(len(entry.content))
+	if size > c.opts.MaxBytes {
+		return
+	}
+	for c.size+size > c.opts.MaxBytes {
+		oldest := c.lru.Back()
+		c.removeNoLock(oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+}
+
+func (c *CachedClient) removeNoLock(key cacheKey) {
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.size -= int64(len(el.Value.(*cacheEntry).content))
+	}
+}
+
+func (c *CachedClient) invalidate(bucket, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.removeNoLock(cacheKey{bucket, path})
+}
+
+func (c *CachedClient) invalidateWrite(bucket, path string, opts SaveFileOptions) {
+	if opts.Unzip {
+		// Extracted paths are unknown
+		c.invalidateBucket(bucket)
+		return
+	}
+	c.invalidate(bucket, path)
+}
+
+func (c *CachedClient) invalidateBucket(bucket string) {
+	c.invalidatePrefix(bucket, "")
+}
+
+func (c *CachedClient) invalidatePrefix(bucket, prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidatePrefixNoLock(bucket, prefix)
+}
+
+func (c *CachedClient) invalidatePrefixNoLock(bucket, prefix string) {
+	c.generation++
+	for key := range c.entries {
+		if key.bucket == bucket && strings.HasPrefix(key.path, prefix) {
+			c.removeNoLock(key)
+		}
+	}
+}
+
+// checkBucketHash drops the cached files of a bucket if its hash changed
+// since the last check. Concurrent checks of a bucket share a single request.
+func (c *CachedClient) checkBucketHash(bucket string) {
+	if c.opts.BucketHashInterval <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	state, ok := c.buckets[bucket]
+	if ok && time.Since(state.checkedAt) < c.opts.BucketHashInterval {
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	c.bucketChecks.do(bucket, func() (struct{}, error) {
+		res, _, err := c.inner.GetBucket(bucket)
+		if err != nil {
+			// Serve from cache, the TTL still bounds staleness
+			return struct{}{}, err
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if state, ok := c.buckets[bucket]; ok && state.hash != res.Hash {
+			c.invalidatePrefixNoLock(bucket, "")
+		}
+		c.buckets[bucket] = &cachedBucket{hash: res.Hash, checkedAt: time.Now()}
+		return struct{}{}, nil
+	})
+}
+
+// flightGroup makes concurrent calls with a same key share the result of a
+// single call
+type flightGroup[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*flightCall[V]
+}
+
+type flightCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+func (g *flightGroup[K, V]) do(key K, fn func() (V, error)) (V, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	if g.calls == nil {
+		g.calls = map[K]*flightCall[V]{}
+	}
+	call := &flightCall[V]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err
+}
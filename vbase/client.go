@@ -2,6 +2,8 @@ package vbase
 
 import (
 	"bytes"
+	goContext "context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +13,8 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/common"
+	"github.com/vtex/go-clients/schema"
 	gentleman "gopkg.in/h2non/gentleman.v1"
 	"gopkg.in/h2non/gentleman.v1/context"
 	"gopkg.in/h2non/gentleman.v1/plugin"
@@ -28,60 +32,162 @@ type SaveFileOptions struct {
 	ContentType     string
 	Unzip           bool
 	IgnoreConflicts bool
+	// IfMatch, if set, only saves the file if its current ETag matches it
+	IfMatch string
+	// IfNoneMatch, if set, only saves the file if its current ETag doesn't
+	// match it. Use "*" to only save files that don't exist yet.
+	IfNoneMatch string
+}
+
+// IsPreconditionFailed tells whether a save was rejected because of its
+// IfMatch or IfNoneMatch options
+func IsPreconditionFailed(err error) bool {
+	return clients.IsPreconditionFailed(err)
+}
+
+func setConditionHeaders(req *gentleman.Request, opts SaveFileOptions) *gentleman.Request {
+	if opts.IfMatch != "" {
+		req = req.SetHeader("If-Match", opts.IfMatch)
+	}
+	if opts.IfNoneMatch != "" {
+		req = req.SetHeader("If-None-Match", opts.IfNoneMatch)
+	}
+	return req
+}
+
+type DeleteOptions struct {
+	// Concurrency is the maximum number of simultaneous deletes. Defaults to 4.
+	Concurrency int
+	// IgnoreNotFound treats files that don't exist as successfully deleted
+	IgnoreNotFound bool
 }
 
 // VBase is an interface for interacting with VBase
 type VBase interface {
 	GetFile(bucket, path string) (file io.ReadCloser, contentType string, err error)
+	GetFileRange(bucket, path string, offset, length int64) (*FileRange, error)
+	Download(ctx goContext.Context, bucket, path string, w io.WriterAt, opts DownloadOptions) error
 	GetJSON(bucket, path string, data interface{}) (eTag string, err error)
 	ListFiles(bucket string, options *Options) (*FileListResponse, string, error)
 	ListAllFiles(bucket, prefix string) (*FileListResponse, string, error)
 
 	SaveFile(bucket, path string, body io.Reader, opts SaveFileOptions) (string, error)
 	SaveFileB(bucket, path string, content []byte, opts SaveFileOptions) (string, error)
+	Upload(ctx goContext.Context, bucket, path string, body io.Reader, opts UploadOptions) (string, error)
 	SaveJSON(bucket, path string, data interface{}) (string, error)
 	DeleteFile(bucket, path string) error
+	DeleteMany(bucket string, paths []string, opts DeleteOptions) error
+	DeletePrefix(bucket, prefix string, opts DeleteOptions) error
 	DeleteAllFiles(bucket string) error
 
 	GetBucket(bucket string) (*BucketResponse, string, error)
+	SetBucketState(bucket string, state common.BucketState) error
+	ListBuckets(appName string) ([]*BucketResponse, error)
 
 	ListAllConflicts(bucket string) ([]*Conflict, error)
 	ResolveConflicts(bucket string, patch PatchRequest) error
 }
 
+// ConditionalGetter is implemented by VBase clients able to skip downloading a
+// file that still matches a known ETag. In that case, file is nil.
+type ConditionalGetter interface {
+	GetFileIfNoneMatch(bucket, path, eTag string) (file io.ReadCloser, contentType, newETag string, err error)
+}
+
+// RawGetter is implemented by VBase clients that transform file contents on
+// reads, such as decompressing them, to read files as stored, along with the
+// content type they were saved with.
+type RawGetter interface {
+	GetFileRaw(bucket, path string) (*FileRange, error)
+}
+
+// GetFileRaw reads a file as stored, with the client's GetFileRaw if it is a
+// RawGetter, or else with GetFile. The length of the returned range is -1
+// when unknown.
+func GetFileRaw(client VBase, bucket, path string) (*FileRange, error) {
+	if getter, ok := client.(RawGetter); ok {
+		return getter.GetFileRaw(bucket, path)
+	}
+	file, contentType, err := client.GetFile(bucket, path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileRange{ReadCloser: file, ContentType: contentType, Length: -1, TotalSize: -1}, nil
+}
+
+// ConditionalDeleter is implemented by VBase clients able to delete a file
+// only if it still matches a known ETag, failing otherwise with an error
+// detected by IsPreconditionFailed.
+type ConditionalDeleter interface {
+	DeleteFileIfMatch(bucket, path, eTag string) error
+}
+
 type ConflictResolver interface {
 	Resolve(client VBase, bucket string) (resolved bool, err error)
 }
 
+// ClientOptions configures optional behaviors of a VBase client
+type ClientOptions struct {
+	// VerifyIntegrity checks the MD5 of downloaded content against the
+	// response ETag, failing with ErrChecksumMismatch at EOF, and checks the
+	// ETag returned by uploads against the MD5 of the sent content. Resumed
+	// uploads then read the bytes already sent instead of seeking past them.
+	VerifyIntegrity bool
+	// Compression compresses large SaveJSON bodies. Compressed files are
+	// decompressed on reads regardless of this option.
+	Compression CompressionOptions
+	// Schemas, if set, validates documents saved with SaveJSON, failing with
+	// a *schema.ValidationError before sending invalid ones
+	Schemas *schema.Registry
+	// ValidateReads also validates documents read with GetJSON, to detect
+	// invalid data saved before the schemas were in place
+	ValidateReads bool
+}
+
 type client struct {
 	http               *gentleman.Client
 	appName            string
 	workspace          string
 	conflictResolver   ConflictResolver
 	resolvingConflicts bool
+	verifyIntegrity    bool
+	compression        CompressionOptions
+	schemas            *schema.Registry
+	validateReads      bool
 }
 
 // NewClient creates a new Workspaces client
 func NewClient(config *clients.Config, cResolver ConflictResolver) (VBase, error) {
+	return NewClientWithOptions(config, cResolver, ClientOptions{})
+}
+
+// NewClientWithOptions creates a new VBase client with optional behaviors
+func NewClientWithOptions(config *clients.Config, cResolver ConflictResolver, opts ClientOptions) (VBase, error) {
 	appName := clients.UserAgentName(config)
 	if appName == "" {
 		return nil, clients.NewNoUserAgentError("User-Agent is missing to create a VBase client.")
 	}
-	return NewCustomAppClient(appName, config, cResolver), nil
+	return NewCustomAppClientWithOptions(appName, config, cResolver, opts), nil
 }
 
 var vbaseService = clients.Service{Name: "vbase", Major: 2}
 
 func NewCustomAppClient(appName string, config *clients.Config, cResolver ConflictResolver) VBase {
+	return NewCustomAppClientWithOptions(appName, config, cResolver, ClientOptions{})
+}
+
+func NewCustomAppClientWithOptions(appName string, config *clients.Config, cResolver ConflictResolver, opts ClientOptions) VBase {
 	cl := clients.CreateInfraClient(&vbaseService, config)
-	return &client{cl, appName, config.Workspace, cResolver, false}
+	return &client{cl, appName, config.Workspace, cResolver, false, opts.VerifyIntegrity, opts.Compression, opts.Schemas, opts.ValidateReads}
 }
 
 const (
-	pathToBucket    = "/buckets/%v/%v"
-	pathToFileList  = "/buckets/%v/%v/files"
-	pathToFile      = "/buckets/%v/%v/files/%v"
-	pathToConflicts = "/buckets/%v/%v/conflicts"
+	pathToBuckets     = "/buckets/%v"
+	pathToBucket      = "/buckets/%v/%v"
+	pathToBucketState = "/buckets/%v/%v/state"
+	pathToFileList    = "/buckets/%v/%v/files"
+	pathToFile        = "/buckets/%v/%v/files/%v"
+	pathToConflicts   = "/buckets/%v/%v/conflicts"
 )
 
 // GetBucket describes the current state of a bucket
@@ -102,15 +208,66 @@ func (cl *client) GetBucket(bucket string) (*BucketResponse, string, error) {
 	return &bucketResponse, res.Header.Get(clients.HeaderETag), nil
 }
 
+// SetBucketState changes the lifecycle state of a bucket
+func (cl *client) SetBucketState(bucket string, state common.BucketState) error {
+	_, err := cl.http.Put().
+		AddPath(fmt.Sprintf(pathToBucketState, cl.appName, bucket)).
+		JSON(state).
+		Send()
+	return err
+}
+
+// ListBuckets lists every bucket of an app in the client's workspace
+func (cl *client) ListBuckets(appName string) ([]*BucketResponse, error) {
+	var buckets []*BucketResponse
+	marker := ""
+	for {
+		res, err := cl.http.Get().
+			AddPath(fmt.Sprintf(pathToBuckets, appName)).
+			SetQueryParams(map[string]string{
+				"_next":  marker,
+				"_limit": "100",
+			}).
+			Send()
+		if err != nil {
+			return nil, err
+		}
+
+		var list BucketListResponse
+		if err := res.JSON(&list); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, list.Buckets...)
+
+		if list.NextMarker == "" {
+			return buckets, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
 // GetJSON populates data with the content of the specified file, assuming it is serialized as JSON
 func (cl *client) GetJSON(bucket, path string, data interface{}) (string, error) {
-	res, _, err := cl.getFileInternal(bucket, path)
+	res, contentType, err := cl.getFileInternal(bucket, path)
 	if err != nil {
 		return "", err
 	}
-	defer res.Close()
+	body, _, err := cl.readBody(res, contentType)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
 
-	if err := res.JSON(data); err != nil {
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	if cl.validateReads {
+		if err := cl.schemas.ValidateJSON(bucket, path, buf); err != nil {
+			return "", err
+		}
+	}
+	if err := json.Unmarshal(buf, data); err != nil {
 		return "", err
 	}
 
@@ -119,7 +276,34 @@ func (cl *client) GetJSON(bucket, path string, data interface{}) (string, error)
 
 // GetFile gets a file's content as a read closer
 func (cl *client) GetFile(bucket, path string) (io.ReadCloser, string, error) {
-	return cl.getFileInternal(bucket, path)
+	res, contentType, err := cl.getFileInternal(bucket, path)
+	if err != nil {
+		return nil, contentType, err
+	}
+	return cl.readBody(res, contentType)
+}
+
+// readBody verifies and decompresses the content of a file response
+func (cl *client) readBody(res *gentleman.Response, contentType string) (io.ReadCloser, string, error) {
+	var body io.ReadCloser = res
+	if cl.verifyIntegrity {
+		body = newVerifyingReader(res, res.Header.Get(clients.HeaderETag))
+	}
+	return decompress(body, contentType, res.Header.Get("Content-Encoding"))
+}
+
+// GetFileRaw gets a file's content as stored, without verifying or
+// decompressing it
+func (cl *client) GetFileRaw(bucket, path string) (*FileRange, error) {
+	res, contentType, err := cl.getFileInternal(bucket, path)
+	if err != nil {
+		return nil, err
+	}
+	fr := &FileRange{ReadCloser: res, ContentType: contentType, ETag: res.Header.Get(clients.HeaderETag), Length: -1, TotalSize: -1}
+	if size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64); err == nil {
+		fr.Length, fr.TotalSize = size, size
+	}
+	return fr, nil
 }
 
 func (cl *client) getFileInternal(bucket, path string) (*gentleman.Response, string, error) {
@@ -134,8 +318,48 @@ func (cl *client) getFileInternal(bucket, path string) (*gentleman.Response, str
 	return res, res.Header.Get(HeaderContentType), nil
 }
 
+// GetFileIfNoneMatch gets a file's content unless it still matches eTag
+func (cl *client) GetFileIfNoneMatch(bucket, path, eTag string) (io.ReadCloser, string, string, error) {
+	req := cl.http.Get().
+		AddPath(fmt.Sprintf(pathToFile, cl.appName, bucket, path)).
+		Use(cl.conflictHandler(bucket))
+	if eTag != "" {
+		req = req.SetHeader("If-None-Match", eTag)
+	}
+
+	res, err := req.Send()
+	if err != nil {
+		return nil, "", "", err
+	}
+	if res.StatusCode == http.StatusNotModified {
+		res.Close()
+		return nil, "", eTag, nil
+	}
+
+	body, contentType, err := cl.readBody(res, res.Header.Get(HeaderContentType))
+	if err != nil {
+		return nil, "", "", err
+	}
+	return body, contentType, res.Header.Get(clients.HeaderETag), nil
+}
+
 // SaveJSON saves generic data serializing it to JSON
 func (cl *client) SaveJSON(bucket, path string, data interface{}) (string, error) {
+	if err := cl.schemas.Validate(bucket, path, data); err != nil {
+		return "", err
+	}
+	if cl.verifyIntegrity || cl.compression.Algorithm != CompressionNone {
+		buf, err := json.Marshal(data)
+		if err != nil {
+			return "", err
+		}
+		buf, contentType, err := cl.compressJSON(buf)
+		if err != nil {
+			return "", err
+		}
+		return cl.SaveFile(bucket, path, bytes.NewReader(buf), SaveFileOptions{ContentType: contentType})
+	}
+
 	res, err := cl.http.Put().
 		AddPath(fmt.Sprintf(pathToFile, cl.appName, bucket, path)).
 		JSON(data).
@@ -151,13 +375,20 @@ func (cl *client) SaveJSON(bucket, path string, data interface{}) (string, error
 
 // SaveFile saves a file to a workspace
 func (cl *client) SaveFile(bucket, path string, body io.Reader, opts SaveFileOptions) (string, error) {
+	check, err := cl.newUploadCheck(body, opts)
+	if err != nil {
+		return "", err
+	}
+
 	req := cl.http.Put().
 		AddPath(fmt.Sprintf(pathToFile, cl.appName, bucket, path)).
 		SetQuery("unzip", fmt.Sprintf("%v", opts.Unzip)).
-		Body(body)
+		Body(check.body)
 	if opts.ContentType != "" {
 		req = req.SetHeader("Content-Type", opts.ContentType)
 	}
+	req = check.setHeaders(req)
+	req = setConditionHeaders(req, opts)
 
 	if !opts.IgnoreConflicts {
 		req = req.Use(cl.conflictHandler(bucket))
@@ -167,7 +398,7 @@ func (cl *client) SaveFile(bucket, path string, body io.Reader, opts SaveFileOpt
 	if err != nil {
 		return "", err
 	}
-	return res.Header.Get(clients.HeaderETag), nil
+	return check.verify(res.Header.Get(clients.HeaderETag))
 }
 
 // SaveFileB saves a file to a workspace
@@ -267,6 +498,17 @@ func (cl *client) DeleteFile(bucket, path string) error {
 	return err
 }
 
+// DeleteFileIfMatch deletes a file unless it changed since it had eTag
+func (cl *client) DeleteFileIfMatch(bucket, path, eTag string) error {
+	_, err := cl.http.Delete().
+		AddPath(fmt.Sprintf(pathToFile, cl.appName, bucket, path)).
+		SetHeader("If-Match", eTag).
+		Use(cl.conflictHandler(bucket)).
+		Send()
+
+	return err
+}
+
 // DeleteAllFiles deletes all files from the specificed bucket
 func (cl *client) DeleteAllFiles(bucket string) error {
 	_, err := cl.http.Delete().
@@ -278,66 +520,82 @@ func (cl *client) DeleteAllFiles(bucket string) error {
 }
 
 func (cl *client) conflictHandler(bucket string) plugin.Plugin {
+	return cl.conflictHandlerWithPolicy(bucket, defaultReplayPolicy)
+}
+
+func (cl *client) conflictHandlerWithPolicy(bucket string, policy ReplayPolicy) plugin.Plugin {
 	p := plugin.New()
 	if cl.conflictResolver == nil || cl.resolvingConflicts || cl.workspace == clients.MasterWorkspace {
 		return p
 	}
 
 	var reqCopy *http.Request
+	var body *replayableBody
 	p.SetHandlers(plugin.Handlers{
 		"request": func(c *context.Context, h context.Handler) {
 			c.Request.Header.Set("X-Vtex-Detect-Conflicts", "true")
-
-			var err error
-			reqCopy, err = copyRequest(c.Request)
-			if err != nil {
-				h.Error(c, err)
-				return
-			}
-
+			reqCopy, body = copyRequest(c.Request, policy)
 			h.Next(c)
 		},
 		"after dial": func(c *context.Context, h context.Handler) {
-			if c.Response.StatusCode == http.StatusConflict {
-				if err := cl.resolveConflicts(bucket); err != nil {
-					h.Error(c, err)
-					return
+			if c.Response.StatusCode != http.StatusConflict {
+				if body != nil {
+					body.discard()
 				}
+				h.Next(c)
+				return
+			}
 
-				// Retry
-				res, err := retryRequest(c.Client, reqCopy, bucket)
-				if res != nil {
-					c.Response = res
-				}
+			if err := cl.resolveConflicts(bucket); err != nil {
+				h.Error(c, err)
+				return
+			}
+			if body != nil {
+				replay, err := body.Replay()
 				if err != nil {
 					h.Error(c, err)
 					return
 				}
-				res.Header.Set("X-Vtex-Solved-Conflicts", bucket)
+				reqCopy.Body = replay
+			}
+
+			// Retry
+			res, err := retryRequest(c.Client, reqCopy, bucket)
+			if res != nil {
+				c.Response = res
+			}
+			if err != nil {
+				h.Error(c, err)
+				return
 			}
+			res.Header.Set("X-Vtex-Solved-Conflicts", bucket)
 
 			h.Next(c)
 		},
+		"error": func(c *context.Context, h context.Handler) {
+			if body != nil {
+				body.discard()
+			}
+			h.Next(c)
+		},
 	})
 	return p
 }
 
-func copyRequest(req *http.Request) (*http.Request, error) {
+// copyRequest makes a copy of req to be sent again after conflicts are
+// resolved. The body is recorded while the original request is sent,
+// according to policy, instead of being read upfront.
+func copyRequest(req *http.Request, policy ReplayPolicy) (*http.Request, *replayableBody) {
 	reqCopy := &http.Request{}
 	*reqCopy = *req
 
-	if req.Body == nil {
+	if req.Body == nil || req.Body == http.NoBody {
 		return reqCopy, nil
 	}
 
-	buf, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		return nil, err
-	}
-	req.Body = ioutil.NopCloser(bytes.NewReader(buf))
-	reqCopy.Body = ioutil.NopCloser(bytes.NewReader(buf))
-
-	return reqCopy, nil
+	body := newReplayableBody(req.Body, policy)
+	req.Body = body
+	return reqCopy, body
 }
 
 func (cl *client) resolveConflicts(bucket string) error {
@@ -0,0 +1,135 @@
+package vbase
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm used to compress JSON files
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// encodingParam is the content type parameter marking compressed files, since
+// VBase doesn't keep the Content-Encoding of uploads
+const encodingParam = "vbase-encoding"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type CompressionOptions struct {
+	// Algorithm compresses the bodies of SaveJSON. CompressionNone disables
+	// compression.
+	Algorithm Compression
+	// Threshold is the size, in bytes, from which bodies are compressed.
+	// Defaults to 1KB.
+	Threshold int
+}
+
+// compressJSON compresses a JSON body if it is large enough, returning the
+// content type to save it with
+func (cl *client) compressJSON(body []byte) ([]byte, string, error) {
+	threshold := cl.compression.Threshold
+	if threshold <= 0 {
+		threshold = 1 << 10
+	}
+	if cl.compression.Algorithm == CompressionNone || len(body) < threshold {
+		return body, "application/json", nil
+	}
+
+	var buf bytes.Buffer
+	switch cl.compression.Algorithm {
+	case CompressionGzip:
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, "", err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", err
+		}
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, "", err
+		}
+		buf.Write(enc.EncodeAll(body, nil))
+		enc.Close()
+	default:
+		return body, "application/json", nil
+	}
+
+	contentType := mime.FormatMediaType("application/json", map[string]string{encodingParam: string(cl.compression.Algorithm)})
+	return buf.Bytes(), contentType, nil
+}
+
+// decompress decodes a file's content according to its content type marker or
+// the response Content-Encoding, returning the content type without the
+// marker. Content not starting with the algorithm's magic number is returned
+// as is, so files written uncompressed are still read.
+func decompress(body io.ReadCloser, contentType, contentEncoding string) (io.ReadCloser, string, error) {
+	encoding := Compression(contentEncoding)
+	if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+		if marker, ok := params[encodingParam]; ok {
+			encoding = Compression(marker)
+			delete(params, encodingParam)
+			contentType = mime.FormatMediaType(mediaType, params)
+		}
+	}
+
+	var magic []byte
+	switch encoding {
+	case CompressionGzip:
+		magic = gzipMagic
+	case CompressionZstd:
+		magic = zstdMagic
+	default:
+		return body, contentType, nil
+	}
+
+	br := bufio.NewReader(body)
+	if head, _ := br.Peek(len(magic)); !bytes.Equal(head, magic) {
+		return &decompressingReader{br, body, nil}, contentType, nil
+	}
+
+	if encoding == CompressionGzip {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			body.Close()
+			return nil, "", err
+		}
+		return &decompressingReader{gz, body, gz.Close}, contentType, nil
+	}
+	dec, err := zstd.NewReader(br)
+	if err != nil {
+		body.Close()
+		return nil, "", err
+	}
+	return &decompressingReader{dec, body, func() error {
+		dec.Close()
+		return nil
+	}}, contentType, nil
+}
+
+type decompressingReader struct {
+	io.Reader
+	body    io.Closer
+	closeFn func() error
+}
+
+func (r *decompressingReader) Close() error {
+	if r.closeFn != nil {
+		r.closeFn()
+	}
+	return r.body.Close()
+}
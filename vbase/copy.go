@@ -0,0 +1,129 @@
+package vbase
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Location identifies a file, or a prefix of files, in a bucket. Using
+// clients created for different apps or workspaces allows copying across them.
+type Location struct {
+	Client VBase
+	Bucket string
+	Path   string
+}
+
+func (l Location) String() string {
+	return l.Bucket + "/" + l.Path
+}
+
+// CopyPrefixOptions configures CopyPrefix
+type CopyPrefixOptions struct {
+	// Concurrency is the maximum number of simultaneous copies. Defaults to 4.
+	Concurrency int
+}
+
+// Copy streams a file from src to dst, preserving its content type
+func Copy(src, dst Location) error {
+	file, contentType, err := src.Client.GetFile(src.Bucket, src.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = dst.Client.SaveFile(dst.Bucket, dst.Path, file, SaveFileOptions{ContentType: contentType})
+	return err
+}
+
+// Move copies a file from src to dst and deletes the source once the
+// destination's hash is confirmed to match it. Since clients of a same app and
+// workspace can't be told apart, moves between the same bucket and path fail,
+// whatever their clients, so that the only copy of a file is never deleted.
+func Move(src, dst Location) error {
+	if src.Bucket == dst.Bucket && strings.Trim(src.Path, "/") == strings.Trim(dst.Path, "/") {
+		return fmt.Errorf("Can't move %v to the same bucket and path", src)
+	}
+	if err := Copy(src, dst); err != nil {
+		return err
+	}
+
+	srcHash, err := fileHash(src)
+	if err != nil {
+		return err
+	}
+	dstHash, err := fileHash(dst)
+	if err != nil {
+		return err
+	}
+	if srcHash != dstHash {
+		return fmt.Errorf("Hash mismatch moving %v to %v, source was kept", src, dst)
+	}
+
+	return src.Client.DeleteFile(src.Bucket, src.Path)
+}
+
+// CopyPrefix copies every file under src.Path to dst.Path, keeping the paths
+// relative to the prefix.
+func CopyPrefix(src, dst Location, opts CopyPrefixOptions) error {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+
+	list, _, err := src.Client.ListAllFiles(src.Bucket, src.Path)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	sem := make(chan struct{}, opts.Concurrency)
+	for _, f := range list.Files {
+		from, to := src, dst
+		from.Path = f.Path
+		to.Path = dst.Path + strings.TrimPrefix(f.Path, src.Path)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := Copy(from, to); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("%v: %v", from, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Error(s) copying %v to %v: %s", src, dst, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// fileHash looks up the hash of a single file in its bucket listing
+func fileHash(loc Location) (string, error) {
+	options := &Options{Prefix: loc.Path, Limit: 100}
+	for {
+		list, _, err := loc.Client.ListFiles(loc.Bucket, options)
+		if err != nil {
+			return "", err
+		}
+		for _, f := range list.Files {
+			if f.Path == loc.Path {
+				return f.Hash, nil
+			}
+		}
+		if list.NextMarker == "" {
+			return "", fmt.Errorf("File %v not found in bucket listing", loc)
+		}
+		options.Marker = list.NextMarker
+	}
+}
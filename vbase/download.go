@@ -0,0 +1,337 @@
+package vbase
+
+import (
+	goContext "context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vtex/go-clients/clients"
+	gentleman "gopkg.in/h2non/gentleman.v1"
+	"gopkg.in/h2non/gentleman.v1/context"
+	"gopkg.in/h2non/gentleman.v1/plugins/timeout"
+)
+
+// FileRange is a byte range of a file's content. If the server ignores the
+// requested range, Partial is false and the whole file is returned, in which
+// case Length and TotalSize are -1 if unknown.
+type FileRange struct {
+	io.ReadCloser
+	ContentType string
+	ETag        string
+	Partial     bool
+	Offset      int64
+	Length      int64
+	TotalSize   int64
+}
+
+type DownloadOptions struct {
+	// ChunkSize is the size of each range request. Defaults to 8MB.
+	ChunkSize int64
+	// Concurrency is the maximum number of simultaneous range requests.
+	// Defaults to 4.
+	Concurrency int
+	// Retries is how many times a failed chunk is retried. Defaults to 3.
+	Retries int
+	// Timeout bounds the whole transfer, replacing the client's per request
+	// timeout. Zero means no limit other than the context's.
+	Timeout time.Duration
+	// SkipVerify skips comparing the downloaded content's MD5 with the file
+	// hash in the bucket listing.
+	SkipVerify bool
+}
+
+func (o *DownloadOptions) setDefaults() {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = 8 << 20
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	if o.Retries <= 0 {
+		o.Retries = 3
+	}
+}
+
+// GetFileRange gets length bytes of a file's content starting at offset
+func (cl *client) GetFileRange(bucket, path string, offset, length int64) (*FileRange, error) {
+	req := cl.http.Get().
+		AddPath(fmt.Sprintf(pathToFile, cl.appName, bucket, path))
+	return cl.getFileRange(req, bucket, offset, length)
+}
+
+// Download fetches a file in ranges of opts.ChunkSize, in parallel, writing
+// each one at its offset in w. At most opts.Concurrency chunks are held in
+// memory at once.
+func (cl *client) Download(ctx goContext.Context, bucket, path string, w io.WriterAt, opts DownloadOptions) error {
+	opts.setDefaults()
+	var cancel goContext.CancelFunc
+	if opts.Timeout > 0 {
+		ctx, cancel = goContext.WithTimeout(ctx, opts.Timeout)
+	} else {
+		ctx, cancel = goContext.WithCancel(ctx)
+	}
+	// Also stops pending chunks if one of them fails
+	defer cancel()
+
+	size, eTag, err := cl.fileSize(ctx, bucket, path, opts)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		// Ranges of an empty file aren't satisfiable
+		return cl.verifyDownload(bucket, path, md5.New(), opts)
+	}
+
+	first, err := cl.downloadChunk(ctx, bucket, path, 0, opts, eTag)
+	if err != nil {
+		return err
+	}
+	if !first.Partial {
+		defer first.Close()
+		h := md5.New()
+		if _, err := io.Copy(io.NewOffsetWriter(w, 0), io.TeeReader(first, h)); err != nil {
+			return err
+		}
+		return cl.verifyDownload(bucket, path, h, opts)
+	}
+	if eTag == "" {
+		eTag = first.ETag
+	}
+
+	chunks := int((first.TotalSize + opts.ChunkSize - 1) / opts.ChunkSize)
+	h := md5.New()
+	if err := writeChunk(w, first); err != nil {
+		return chunkError(bucket, path, 0, err)
+	}
+	h.Write(first.data)
+	first.data = nil
+
+	// Each chunk waits for its turn to be hashed, closed once the previous
+	// one is hashed, so that chunks are hashed in order while holding their
+	// slot. Chunks waiting for their turn always come after the next one to
+	// hash, which holds a slot as well.
+	turns := make([]chan struct{}, chunks)
+	for i := range turns {
+		turns[i] = make(chan struct{})
+	}
+	if chunks > 1 {
+		close(turns[1])
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	sem := make(chan struct{}, opts.Concurrency)
+spawn:
+	for i := 1; i < chunks; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break spawn
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			chunk, err := cl.downloadChunk(ctx, bucket, path, int64(i)*opts.ChunkSize, opts, eTag)
+			if err == nil && !chunk.Partial {
+				chunk.Close()
+				err = fmt.Errorf("Server ignored the requested range")
+			}
+			if err == nil {
+				err = writeChunk(w, chunk)
+			}
+			if err != nil {
+				fail(chunkError(bucket, path, i, err))
+				return
+			}
+
+			select {
+			case <-turns[i]:
+			case <-ctx.Done():
+				return
+			}
+			h.Write(chunk.data)
+			if i+1 < chunks {
+				close(turns[i+1])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cl.verifyDownload(bucket, path, h, opts)
+}
+
+// fileSize reads the size and ETag of a file without downloading it. The size
+// is -1 if unknown.
+func (cl *client) fileSize(ctx goContext.Context, bucket, path string, opts DownloadOptions) (int64, string, error) {
+	res, err := transferRequest(cl.http.Head(), ctx, opts.Timeout).
+		AddPath(fmt.Sprintf(pathToFile, cl.appName, bucket, path)).
+		Use(cl.conflictHandler(bucket)).
+		Send()
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Close()
+
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	return size, res.Header.Get(clients.HeaderETag), nil
+}
+
+type downloadedChunk struct {
+	*FileRange
+	data []byte
+}
+
+func chunkError(bucket, path string, index int, err error) error {
+	return fmt.Errorf("Error downloading chunk %d of %s/%s: %v", index, bucket, path, err)
+}
+
+func writeChunk(w io.WriterAt, chunk *downloadedChunk) error {
+	_, err := w.WriteAt(chunk.data, chunk.Offset)
+	return err
+}
+
+// downloadChunk fetches a single range, retrying on failures. If eTag is set,
+// the request fails instead of mixing ranges of different file versions.
+func (cl *client) downloadChunk(ctx goContext.Context, bucket, path string, offset int64, opts DownloadOptions, eTag string) (*downloadedChunk, error) {
+	var lastErr error
+	for attempt := 0; attempt <= opts.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			}
+		}
+
+		req := transferRequest(cl.http.Get(), ctx, opts.Timeout).
+			AddPath(fmt.Sprintf(pathToFile, cl.appName, bucket, path))
+		if eTag != "" {
+			req = req.SetHeader("If-Match", eTag)
+		}
+
+		fr, err := cl.getFileRange(req, bucket, offset, opts.ChunkSize)
+		if err != nil {
+			if IsPreconditionFailed(err) {
+				return nil, fmt.Errorf("File changed during download: %v", err)
+			}
+			if !isRetryable(err) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if !fr.Partial {
+			// Whole file, the caller streams it
+			return &downloadedChunk{FileRange: fr}, nil
+		}
+
+		data, err := ioutil.ReadAll(fr)
+		fr.Close()
+		if err == nil && int64(len(data)) != fr.Length {
+			err = fmt.Errorf("Expected %d bytes, got %d", fr.Length, len(data))
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return &downloadedChunk{FileRange: fr, data: data}, nil
+	}
+	return nil, lastErr
+}
+
+// isRetryable tells whether a failed chunk may succeed if requested again:
+// client errors other than timeouts and throttling fail the download.
+func isRetryable(err error) bool {
+	respErr, ok := errors.Cause(err).(clients.ResponseError)
+	if !ok || respErr.StatusCode < 400 || respErr.StatusCode >= 500 {
+		return true
+	}
+	return respErr.StatusCode == http.StatusRequestTimeout || respErr.StatusCode == http.StatusTooManyRequests
+}
+
+// transferRequest binds req to ctx and replaces the client's timeout, which
+// is meant for small requests, with the whole transfer's timeout.
+func transferRequest(req *gentleman.Request, ctx goContext.Context, d time.Duration) *gentleman.Request {
+	return req.
+		Use(timeout.Request(d)).
+		UseRequest(func(c *context.Context, h context.Handler) {
+			c.Request = c.Request.WithContext(ctx)
+			h.Next(c)
+		})
+}
+
+func (cl *client) verifyDownload(bucket, path string, h hash.Hash, opts DownloadOptions) error {
+	if opts.SkipVerify {
+		return nil
+	}
+	expected, err := fileHash(Location{Client: cl, Bucket: bucket, Path: path})
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("Hash mismatch downloading %s/%s: expected %s, got %s", bucket, path, expected, actual)
+	}
+	return nil
+}
+
+func (cl *client) getFileRange(req *gentleman.Request, bucket string, offset, length int64) (*FileRange, error) {
+	res, err := req.
+		SetHeader("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)).
+		Use(cl.conflictHandler(bucket)).
+		Send()
+	if err != nil {
+		return nil, err
+	}
+
+	fr := &FileRange{
+		ReadCloser:  res,
+		ContentType: res.Header.Get(HeaderContentType),
+		ETag:        res.Header.Get(clients.HeaderETag),
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		fr.Length, fr.TotalSize = -1, -1
+		if size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64); err == nil {
+			fr.Length, fr.TotalSize = size, size
+		}
+		return fr, nil
+	}
+
+	var end int64
+	if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &fr.Offset, &end, &fr.TotalSize); err != nil {
+		res.Close()
+		return nil, fmt.Errorf("Invalid Content-Range header: %v", err)
+	}
+	fr.Partial = true
+	fr.Length = end - fr.Offset + 1
+	return fr, nil
+}
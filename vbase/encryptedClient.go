@@ -0,0 +1,481 @@
+package vbase
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/vtex/go-clients/common"
+)
+
+// envelopeMagic starts every encrypted file, followed by the envelope version
+var envelopeMagic = []byte("VBE1")
+
+const dataKeySize = 32
+
+// ErrNotEncrypted is returned when reading a file that wasn't saved by an
+// EncryptedClient
+var ErrNotEncrypted = errors.New("File is not encrypted")
+
+// Keyring holds the keys used to encrypt the data keys of files. Keys must be
+// 16, 24 or 32 bytes long, selecting AES-128, AES-192 or AES-256.
+type Keyring interface {
+	// Current returns the key new files are encrypted with
+	Current() (id string, key []byte)
+	// Key returns the key with the given ID, or false if it is unknown
+	Key(id string) ([]byte, bool)
+}
+
+// StaticKeyring is a Keyring with a fixed set of keys. Rotate keys by adding
+// a new one, making it current, and calling Reencrypt on every prefix.
+type StaticKeyring struct {
+	CurrentID string
+	Keys      map[string][]byte
+}
+
+func (k *StaticKeyring) Current() (string, []byte) {
+	return k.CurrentID, k.Keys[k.CurrentID]
+}
+
+func (k *StaticKeyring) Key(id string) ([]byte, bool) {
+	key, ok := k.Keys[id]
+	return key, ok
+}
+
+// EncryptedClient is a VBase decorator encrypting file contents with AES-GCM.
+// Each file is encrypted with a random data key, which is stored encrypted by
+// a keyring key, along with the key's ID and the nonces, in a header before the
+// content. Files are stored as JSON strings, so that their listing values can
+// also be decrypted, and their content type is kept inside the envelope. The
+// content is authenticated along with its path and content type, so files
+// copied to another path as stored can't be decrypted.
+//
+// Contents are encrypted and decrypted in memory, so transfers aren't
+// streamed. Unzip uploads aren't supported, and conflicts are listed as stored,
+// still encrypted.
+type EncryptedClient struct {
+	inner   VBase
+	keyring Keyring
+}
+
+// NewEncryptedClient wraps inner so that every file is encrypted with keys
+// from keyring
+func NewEncryptedClient(inner VBase, keyring Keyring) *EncryptedClient {
+	return &EncryptedClient{inner: inner, keyring: keyring}
+}
+
+// envelope is the decoded header of an encrypted file
+type envelope struct {
+	keyID       string
+	keyNonce    []byte
+	wrappedKey  []byte
+	contentType string
+	nonce       []byte
+	ciphertext  []byte
+}
+
+func (e *envelope) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(envelopeMagic)
+	writeField(&buf, []byte(e.keyID))
+	writeField(&buf, e.keyNonce)
+	writeField(&buf, e.wrappedKey)
+	writeField(&buf, []byte(e.contentType))
+	writeField(&buf, e.nonce)
+	buf.Write(e.ciphertext)
+	return buf.Bytes()
+}
+
+func writeField(buf *bytes.Buffer, field []byte) {
+	buf.WriteByte(byte(len(field)))
+	buf.Write(field)
+}
+
+func unmarshalEnvelope(data []byte) (*envelope, error) {
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		return nil, ErrNotEncrypted
+	}
+	r := bytes.NewReader(data[len(envelopeMagic):])
+	var fields [5][]byte
+	for i := range fields {
+		size, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrNotEncrypted
+		}
+		fields[i] = make([]byte, size)
+		if _, err := io.ReadFull(r, fields[i]); err != nil {
+			return nil, ErrNotEncrypted
+		}
+	}
+	ciphertext, _ := ioutil.ReadAll(r)
+	return &envelope{
+		keyID:       string(fields[0]),
+		keyNonce:    fields[1],
+		wrappedKey:  fields[2],
+		contentType: string(fields[3]),
+		nonce:       fields[4],
+		ciphertext:  ciphertext,
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// wrapKey encrypts a data key with the keyring's current key
+func (c *EncryptedClient) wrapKey(env *envelope, dataKey []byte) error {
+	keyID, key := c.keyring.Current()
+	if key == nil {
+		return fmt.Errorf("Unknown encryption key %q", keyID)
+	}
+	if len(keyID) > math.MaxUint8 {
+		return fmt.Errorf("Encryption key ID %q is too long", keyID)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if env.keyNonce, err = randomBytes(gcm.NonceSize()); err != nil {
+		return err
+	}
+	env.keyID = keyID
+	env.wrappedKey = gcm.Seal(nil, env.keyNonce, dataKey, []byte(keyID))
+	return nil
+}
+
+func (c *EncryptedClient) unwrapKey(env *envelope) ([]byte, error) {
+	key, ok := c.keyring.Key(env.keyID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown encryption key %q", env.keyID)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, env.keyNonce, env.wrappedKey, []byte(env.keyID))
+}
+
+// contentAAD is the additional data authenticated with a file's content
+func contentAAD(path, contentType string) []byte {
+	return []byte(path + "\x00" + contentType)
+}
+
+func (c *EncryptedClient) encrypt(path string, content []byte, contentType string) ([]byte, error) {
+	if len(contentType) > math.MaxUint8 {
+		return nil, fmt.Errorf("Content type %q is too long", contentType)
+	}
+	dataKey, err := randomBytes(dataKeySize)
+	if err != nil {
+		return nil, err
+	}
+	env := &envelope{contentType: contentType}
+	if err := c.wrapKey(env, dataKey); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if env.nonce, err = randomBytes(gcm.NonceSize()); err != nil {
+		return nil, err
+	}
+	env.ciphertext = gcm.Seal(nil, env.nonce, content, contentAAD(path, contentType))
+	return json.Marshal(env.marshal())
+}
+
+func (c *EncryptedClient) decrypt(path string, stored []byte) (content []byte, contentType string, err error) {
+	var data []byte
+	if err := json.Unmarshal(stored, &data); err != nil {
+		return nil, "", ErrNotEncrypted
+	}
+	env, err := unmarshalEnvelope(data)
+	if err != nil {
+		return nil, "", err
+	}
+	dataKey, err := c.unwrapKey(env)
+	if err != nil {
+		return nil, "", err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	content, err = gcm.Open(nil, env.nonce, env.ciphertext, contentAAD(path, env.contentType))
+	if err != nil {
+		return nil, "", err
+	}
+	return content, env.contentType, nil
+}
+
+// getFile reads and decrypts a file, returning its stored ETag
+func (c *EncryptedClient) getFile(bucket, path string) ([]byte, string, string, error) {
+	var stored json.RawMessage
+	eTag, err := c.inner.GetJSON(bucket, path, &stored)
+	if err != nil {
+		return nil, "", "", err
+	}
+	content, contentType, err := c.decrypt(path, stored)
+	if err != nil {
+		return nil, "", "", errors.Wrapf(err, "Error decrypting %s/%s", bucket, path)
+	}
+	return content, contentType, eTag, nil
+}
+
+func (c *EncryptedClient) GetFile(bucket, path string) (io.ReadCloser, string, error) {
+	content, contentType, _, err := c.getFile(bucket, path)
+	if err != nil {
+		return nil, "", err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), contentType, nil
+}
+
+// GetFileRange decrypts the whole file and returns the requested range
+func (c *EncryptedClient) GetFileRange(bucket, path string, offset, length int64) (*FileRange, error) {
+	content, contentType, eTag, err := c.getFile(bucket, path)
+	if err != nil {
+		return nil, err
+	}
+	total := int64(len(content))
+	if offset > total {
+		offset = total
+	}
+	if length <= 0 || offset+length > total {
+		length = total - offset
+	}
+	return &FileRange{
+		ReadCloser:  ioutil.NopCloser(bytes.NewReader(content[offset : offset+length])),
+		ContentType: contentType,
+		ETag:        eTag,
+		Partial:     offset > 0 || length < total,
+		Offset:      offset,
+		Length:      length,
+		TotalSize:   total,
+	}, nil
+}
+
+// Download decrypts the whole file and writes it to w
+func (c *EncryptedClient) Download(ctx context.Context, bucket, path string, w io.WriterAt, opts DownloadOptions) error {
+	content, _, _, err := c.getFile(bucket, path)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = w.WriteAt(content, 0)
+	return err
+}
+
+func (c *EncryptedClient) GetJSON(bucket, path string, data interface{}) (string, error) {
+	content, _, eTag, err := c.getFile(bucket, path)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(content, data); err != nil {
+		return "", err
+	}
+	return eTag, nil
+}
+
+// ListFiles lists files, decrypting their values. Values that can't be
+// decrypted are omitted.
+func (c *EncryptedClient) ListFiles(bucket string, options *Options) (*FileListResponse, string, error) {
+	list, eTag, err := c.inner.ListFiles(bucket, options)
+	if err != nil {
+		return nil, "", err
+	}
+	c.decryptValues(list)
+	return list, eTag, nil
+}
+
+// ListAllFiles lists every file under prefix, decrypting their values. Values
+// that can't be decrypted are omitted.
+func (c *EncryptedClient) ListAllFiles(bucket, prefix string) (*FileListResponse, string, error) {
+	list, eTag, err := c.inner.ListAllFiles(bucket, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	c.decryptValues(list)
+	return list, eTag, nil
+}
+
+func (c *EncryptedClient) decryptValues(list *FileListResponse) {
+	for _, file := range list.Files {
+		if len(file.Value) == 0 {
+			continue
+		}
+		content, contentType, err := c.decrypt(file.Path, file.Value)
+		if err != nil || contentType != "application/json" || !json.Valid(content) {
+			file.Value = nil
+			continue
+		}
+		file.Value = content
+	}
+}
+
+func (c *EncryptedClient) save(bucket, path string, content []byte, opts SaveFileOptions) (string, error) {
+	if opts.Unzip {
+		return "", fmt.Errorf("Unzip uploads can't be encrypted")
+	}
+	stored, err := c.encrypt(path, content, opts.ContentType)
+	if err != nil {
+		return "", err
+	}
+	return c.inner.SaveFileB(bucket, path, stored, SaveFileOptions{
+		ContentType:     "application/json",
+		IgnoreConflicts: opts.IgnoreConflicts,
+		IfMatch:         opts.IfMatch,
+		IfNoneMatch:     opts.IfNoneMatch,
+	})
+}
+
+func (c *EncryptedClient) SaveFile(bucket, path string, body io.Reader, opts SaveFileOptions) (string, error) {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return c.save(bucket, path, content, opts)
+}
+
+func (c *EncryptedClient) SaveFileB(bucket, path string, content []byte, opts SaveFileOptions) (string, error) {
+	return c.save(bucket, path, content, opts)
+}
+
+// Upload reads the whole body, then uploads it encrypted with the inner
+// client's Upload. Progress reports the encrypted size.
+func (c *EncryptedClient) Upload(ctx context.Context, bucket, path string, body io.Reader, opts UploadOptions) (string, error) {
+	if opts.Unzip {
+		return "", fmt.Errorf("Unzip uploads can't be encrypted")
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	stored, err := c.encrypt(path, content, opts.ContentType)
+	if err != nil {
+		return "", err
+	}
+	opts.ContentType = "application/json"
+	opts.Size = int64(len(stored))
+	return c.inner.Upload(ctx, bucket, path, bytes.NewReader(stored), opts)
+}
+
+func (c *EncryptedClient) SaveJSON(bucket, path string, data interface{}) (string, error) {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return c.save(bucket, path, content, SaveFileOptions{ContentType: "application/json"})
+}
+
+// Reencrypt rewraps the data key of every file under prefix not encrypted
+// with the keyring's current key, returning how many files were rewritten.
+// File contents aren't decrypted, only their data keys. Files are only
+// rewritten if unchanged since read: a file changed meanwhile stops the
+// rotation with an error for which IsPreconditionFailed is true, and running
+// Reencrypt again picks it up.
+func (c *EncryptedClient) Reencrypt(bucket, prefix string) (int, error) {
+	currentID, _ := c.keyring.Current()
+	list, _, err := c.inner.ListAllFiles(bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, file := range list.Files {
+		// The listed hash isn't an ETag, so each file is read to get the ETag
+		// its rewrite is conditioned on
+		var stored json.RawMessage
+		eTag, err := c.inner.GetJSON(bucket, file.Path, &stored)
+		if err != nil {
+			return rewritten, errors.Wrapf(err, "Error reading %s/%s", bucket, file.Path)
+		}
+
+		var data []byte
+		if err := json.Unmarshal(stored, &data); err != nil {
+			return rewritten, errors.Wrapf(ErrNotEncrypted, "Error reencrypting %s/%s", bucket, file.Path)
+		}
+		env, err := unmarshalEnvelope(data)
+		if err != nil {
+			return rewritten, errors.Wrapf(err, "Error reencrypting %s/%s", bucket, file.Path)
+		}
+		if env.keyID == currentID {
+			continue
+		}
+
+		dataKey, err := c.unwrapKey(env)
+		if err != nil {
+			return rewritten, errors.Wrapf(err, "Error reencrypting %s/%s", bucket, file.Path)
+		}
+		if err := c.wrapKey(env, dataKey); err != nil {
+			return rewritten, err
+		}
+		content, err := json.Marshal(env.marshal())
+		if err != nil {
+			return rewritten, err
+		}
+		_, err = c.inner.SaveFileB(bucket, file.Path, content, SaveFileOptions{ContentType: "application/json", IfMatch: eTag})
+		if IsPreconditionFailed(err) {
+			return rewritten, errors.Wrapf(err, "Error reencrypting %s/%s: file changed since read", bucket, file.Path)
+		} else if err != nil {
+			return rewritten, errors.Wrapf(err, "Error reencrypting %s/%s", bucket, file.Path)
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+func (c *EncryptedClient) DeleteFile(bucket, path string) error {
+	return c.inner.DeleteFile(bucket, path)
+}
+
+func (c *EncryptedClient) DeleteMany(bucket string, paths []string, opts DeleteOptions) error {
+	return c.inner.DeleteMany(bucket, paths, opts)
+}
+
+func (c *EncryptedClient) DeletePrefix(bucket, prefix string, opts DeleteOptions) error {
+	return c.inner.DeletePrefix(bucket, prefix, opts)
+}
+
+func (c *EncryptedClient) DeleteAllFiles(bucket string) error {
+	return c.inner.DeleteAllFiles(bucket)
+}
+
+func (c *EncryptedClient) GetBucket(bucket string) (*BucketResponse, string, error) {
+	return c.inner.GetBucket(bucket)
+}
+
+func (c *EncryptedClient) SetBucketState(bucket string, state common.BucketState) error {
+	return c.inner.SetBucketState(bucket, state)
+}
+
+func (c *EncryptedClient) ListBuckets(appName string) ([]*BucketResponse, error) {
+	return c.inner.ListBuckets(appName)
+}
+
+func (c *EncryptedClient) ListAllConflicts(bucket string) ([]*Conflict, error) {
+	return c.inner.ListAllConflicts(bucket)
+}
+
+func (c *EncryptedClient) ResolveConflicts(bucket string, patch PatchRequest) error {
+	return c.inner.ResolveConflicts(bucket, patch)
+}
@@ -0,0 +1,524 @@
+// Package fsbackend implements vbase.VBase on top of a local directory, to run
+// services offline. Files are stored under root/account/workspace/app/bucket,
+// at their own path, each with a sidecar file holding its content type and
+// ETag. Buckets are locked with file locks, so that several processes may
+// share a directory.
+package fsbackend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vtex/go-io/ioext"
+
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/common"
+	"github.com/vtex/go-clients/internal/fsutil"
+	"github.com/vtex/go-clients/vbase"
+)
+
+// sidecarSuffix is appended to a file's path to name its sidecar file
+const sidecarSuffix = ".vbasemeta"
+
+type sidecar struct {
+	ContentType string `json:"contentType"`
+	ETag        string `json:"eTag"`
+}
+
+type backend struct {
+	workspaceDir string
+	appName      string
+}
+
+// New creates a VBase client storing files under root, for the account,
+// workspace and app in config
+func New(root string, config *clients.Config) (vbase.VBase, error) {
+	appName := clients.UserAgentName(config)
+	if appName == "" {
+		return nil, clients.NewNoUserAgentError("User-Agent is missing to create a VBase client.")
+	}
+	return NewCustomApp(root, appName, config), nil
+}
+
+// NewCustomApp creates a VBase client storing files under root, for appName
+// and the account and workspace in config
+func NewCustomApp(root, appName string, config *clients.Config) vbase.VBase {
+	return &backend{filepath.Join(root, config.Account, config.Workspace), appName}
+}
+
+func (b *backend) bucketDir(bucket string) (string, error) {
+	if err := fsutil.CheckName(bucket); err != nil {
+		return "", err
+	}
+	return filepath.Join(b.workspaceDir, b.appName, bucket), nil
+}
+
+// filePath returns where a file is stored, rejecting paths outside of the
+// bucket or clashing with the backend's own files
+func (b *backend) filePath(bucket, filePath string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+filePath), "/")
+	base := path.Base(clean)
+	if clean == "" || clean == fsutil.LockFile || clean == fsutil.BucketFile ||
+		strings.HasSuffix(clean, sidecarSuffix) || strings.HasPrefix(base, ".tmp-") {
+		return "", fsutil.BadRequest("Invalid file path " + filePath)
+	}
+	dir, err := b.bucketDir(bucket)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+func (b *backend) withLock(bucket string, exclusive bool, fn func(dir string) error) error {
+	dir, err := b.bucketDir(bucket)
+	if err != nil {
+		return err
+	}
+	unlock, err := fsutil.LockBucket(dir, exclusive)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn(dir)
+}
+
+func (b *backend) readFile(bucket, filePath string) ([]byte, *sidecar, error) {
+	var content []byte
+	var meta *sidecar
+	err := b.withLock(bucket, false, func(dir string) error {
+		var err error
+		content, meta, err = b.readFileNoLock(bucket, filePath)
+		return err
+	})
+	return content, meta, err
+}
+
+func (b *backend) readFileNoLock(bucket, filePath string) ([]byte, *sidecar, error) {
+	fullPath, err := b.filePath(bucket, filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return nil, nil, fsutil.NotFound("File not found: " + filePath)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	meta := &sidecar{}
+	raw, err := ioutil.ReadFile(fullPath + sidecarSuffix)
+	if err == nil {
+		err = json.Unmarshal(raw, meta)
+	}
+	if err != nil || meta.ETag == "" {
+		// Missing sidecar, e.g. a file copied by hand
+		meta = &sidecar{defaultContentType(filePath), vbase.ContentHash(content)}
+	}
+	return content, meta, nil
+}
+
+func defaultContentType(filePath string) string {
+	if contentType := mime.TypeByExtension(path.Ext(filePath)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+func (b *backend) GetFile(bucket, filePath string) (io.ReadCloser, string, error) {
+	content, meta, err := b.readFile(bucket, filePath)
+	if err != nil {
+		return nil, "", err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), meta.ContentType, nil
+}
+
+func (b *backend) GetFileRange(bucket, filePath string, offset, length int64) (*vbase.FileRange, error) {
+	content, meta, err := b.readFile(bucket, filePath)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(content))
+	if offset >= size && size > 0 {
+		return nil, clients.ResponseError{StatusCode: http.StatusRequestedRangeNotSatisfiable, Code: "InvalidRange"}
+	}
+	if length <= 0 || offset+length > size {
+		length = size - offset
+	}
+	return &vbase.FileRange{
+		ReadCloser:  ioutil.NopCloser(bytes.NewReader(content[offset : offset+length])),
+		ContentType: meta.ContentType,
+		ETag:        meta.ETag,
+		Partial:     true,
+		Offset:      offset,
+		Length:      length,
+		TotalSize:   size,
+	}, nil
+}
+
+func (b *backend) Download(ctx context.Context, bucket, filePath string, w io.WriterAt, opts vbase.DownloadOptions) error {
+	content, _, err := b.readFile(bucket, filePath)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = w.WriteAt(content, 0)
+	return err
+}
+
+func (b *backend) GetJSON(bucket, filePath string, data interface{}) (string, error) {
+	content, meta, err := b.readFile(bucket, filePath)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(content, data); err != nil {
+		return "", err
+	}
+	return meta.ETag, nil
+}
+
+func (b *backend) ListFiles(bucket string, options *vbase.Options) (*vbase.FileListResponse, string, error) {
+	if options.Limit <= 0 {
+		options.Limit = 10
+	}
+
+	list := &vbase.FileListResponse{}
+	var hash string
+	err := b.withLock(bucket, false, func(dir string) error {
+		paths, err := listPaths(dir)
+		if err != nil {
+			return err
+		}
+
+		var selected []string
+		for _, p := range paths {
+			if strings.HasPrefix(p, options.Prefix) && p >= options.Marker {
+				selected = append(selected, p)
+			}
+		}
+		if len(selected) > options.Limit {
+			list.NextMarker = selected[options.Limit]
+			selected = selected[:options.Limit]
+		}
+
+		for _, p := range selected {
+			content, meta, err := b.readFileNoLock(bucket, p)
+			if err != nil {
+				return err
+			}
+			file := &vbase.FileEntryResponse{Path: p, Hash: meta.ETag}
+			if meta.ContentType == "application/json" {
+				file.Value = content
+			}
+			list.Files = append(list.Files, file)
+		}
+
+		info, err := fsutil.ReadBucket(dir)
+		if err != nil {
+			return err
+		}
+		hash = info.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return list, hash, nil
+}
+
+func (b *backend) ListAllFiles(bucket, prefix string) (*vbase.FileListResponse, string, error) {
+	return b.ListFiles(bucket, &vbase.Options{Prefix: prefix, Limit: math.MaxInt32})
+}
+
+// listPaths returns the sorted slash separated paths of the files in a bucket
+func listPaths(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(fullPath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fullPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == fsutil.LockFile || rel == fsutil.BucketFile || strings.HasPrefix(rel, fsutil.LockFile+".") ||
+			strings.HasSuffix(rel, sidecarSuffix) || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+func (b *backend) SaveFile(bucket, filePath string, body io.Reader, opts vbase.SaveFileOptions) (string, error) {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return b.SaveFileB(bucket, filePath, content, opts)
+}
+
+func (b *backend) SaveFileB(bucket, filePath string, content []byte, opts vbase.SaveFileOptions) (string, error) {
+	var eTag string
+	err := b.withLock(bucket, true, func(dir string) error {
+		var err error
+		if opts.Unzip {
+			eTag, err = b.saveZipNoLock(bucket, dir, filePath, content)
+		} else {
+			eTag, err = b.saveNoLock(bucket, filePath, content, opts)
+		}
+		if err != nil {
+			return err
+		}
+		return fsutil.TouchBucket(dir)
+	})
+	return eTag, err
+}
+
+func (b *backend) saveNoLock(bucket, filePath string, content []byte, opts vbase.SaveFileOptions) (string, error) {
+	fullPath, err := b.filePath(bucket, filePath)
+	if err != nil {
+		return "", err
+	}
+	if opts.IfMatch != "" || opts.IfNoneMatch != "" {
+		var current string
+		if _, meta, err := b.readFileNoLock(bucket, filePath); err == nil {
+			current = meta.ETag
+		} else if !clients.IsNotFound(err) {
+			return "", err
+		}
+		if !preconditionsMet(current, opts) {
+			return "", clients.ResponseError{StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed"}
+		}
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = defaultContentType(filePath)
+	}
+	meta := &sidecar{contentType, vbase.ContentHash(content)}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	if err := fsutil.WriteFileAtomic(fullPath, content); err != nil {
+		return "", err
+	}
+	if err := fsutil.WriteFileAtomic(fullPath+sidecarSuffix, raw); err != nil {
+		return "", err
+	}
+	return meta.ETag, nil
+}
+
+// saveZipNoLock extracts an archive under prefix, returning the bucket's new
+// hash as ETag
+func (b *backend) saveZipNoLock(bucket, dir, prefix string, content []byte) (string, error) {
+	files, err := ioext.ZipExtract(content)
+	if err != nil {
+		return "", fsutil.BadRequest("Invalid zip archive: " + err.Error())
+	}
+	for name, fileContent := range files {
+		filePath := path.Join(prefix, filepath.ToSlash(name))
+		if _, err := b.saveNoLock(bucket, filePath, fileContent, vbase.SaveFileOptions{}); err != nil {
+			return "", err
+		}
+	}
+	info, err := fsutil.ReadBucket(dir)
+	if err != nil {
+		return "", err
+	}
+	return info.Hash, nil
+}
+
+func preconditionsMet(current string, opts vbase.SaveFileOptions) bool {
+	if opts.IfMatch != "" && (current == "" || (opts.IfMatch != "*" && opts.IfMatch != current)) {
+		return false
+	}
+	if opts.IfNoneMatch != "" && current != "" && (opts.IfNoneMatch == "*" || opts.IfNoneMatch == current) {
+		return false
+	}
+	return true
+}
+
+func (b *backend) Upload(ctx context.Context, bucket, filePath string, body io.Reader, opts vbase.UploadOptions) (string, error) {
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(chunk)
+		buf.Write(chunk[:n])
+		if n > 0 && opts.Progress != nil {
+			opts.Progress(int64(buf.Len()), opts.Size)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+	return b.SaveFileB(bucket, filePath, buf.Bytes(), opts.SaveFileOptions)
+}
+
+func (b *backend) SaveJSON(bucket, filePath string, data interface{}) (string, error) {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return b.SaveFileB(bucket, filePath, content, vbase.SaveFileOptions{ContentType: "application/json"})
+}
+
+func (b *backend) DeleteFile(bucket, filePath string) error {
+	return b.withLock(bucket, true, func(dir string) error {
+		if err := b.deleteNoLock(bucket, dir, filePath); err != nil {
+			return err
+		}
+		return fsutil.TouchBucket(dir)
+	})
+}
+
+func (b *backend) DeleteFileIfMatch(bucket, filePath, eTag string) error {
+	return b.withLock(bucket, true, func(dir string) error {
+		_, meta, err := b.readFileNoLock(bucket, filePath)
+		if err != nil {
+			return err
+		}
+		if meta.ETag != eTag {
+			return clients.ResponseError{StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed"}
+		}
+		if err := b.deleteNoLock(bucket, dir, filePath); err != nil {
+			return err
+		}
+		return fsutil.TouchBucket(dir)
+	})
+}
+
+func (b *backend) deleteNoLock(bucket, dir, filePath string) error {
+	fullPath, err := b.filePath(bucket, filePath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPath); os.IsNotExist(err) {
+		return fsutil.NotFound("File not found: " + filePath)
+	} else if err != nil {
+		return err
+	}
+	os.Remove(fullPath + sidecarSuffix)
+	fsutil.RemoveEmptyDirs(filepath.Dir(fullPath), dir)
+	return nil
+}
+
+func (b *backend) DeleteMany(bucket string, paths []string, opts vbase.DeleteOptions) error {
+	batchErr := &vbase.BatchError{Bucket: bucket, Errors: map[string]error{}}
+	err := b.withLock(bucket, true, func(dir string) error {
+		for _, p := range paths {
+			if err := b.deleteNoLock(bucket, dir, p); err != nil && !(opts.IgnoreNotFound && clients.IsNotFound(err)) {
+				batchErr.Errors[p] = err
+			}
+		}
+		return fsutil.TouchBucket(dir)
+	})
+	if err != nil {
+		return err
+	}
+	if len(batchErr.Errors) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+func (b *backend) DeletePrefix(bucket, prefix string, opts vbase.DeleteOptions) error {
+	return b.withLock(bucket, true, func(dir string) error {
+		paths, err := listPaths(dir)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if strings.HasPrefix(p, prefix) {
+				if err := b.deleteNoLock(bucket, dir, p); err != nil {
+					return err
+				}
+			}
+		}
+		return fsutil.TouchBucket(dir)
+	})
+}
+
+func (b *backend) DeleteAllFiles(bucket string) error {
+	return b.DeletePrefix(bucket, "", vbase.DeleteOptions{})
+}
+
+func (b *backend) GetBucket(bucket string) (*vbase.BucketResponse, string, error) {
+	var info *fsutil.Bucket
+	err := b.withLock(bucket, false, func(dir string) error {
+		var err error
+		info, err = fsutil.ReadBucket(dir)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &vbase.BucketResponse{Hash: info.Hash, State: info.State}, info.Hash, nil
+}
+
+func (b *backend) SetBucketState(bucket string, state common.BucketState) error {
+	return b.withLock(bucket, true, func(dir string) error {
+		info, err := fsutil.ReadBucket(dir)
+		if err != nil {
+			return err
+		}
+		info.State = state
+		return fsutil.WriteBucket(dir, info)
+	})
+}
+
+func (b *backend) ListBuckets(appName string) ([]*vbase.BucketResponse, error) {
+	if err := fsutil.CheckName(appName); err != nil {
+		return nil, err
+	}
+	appDir := filepath.Join(b.workspaceDir, appName)
+	names, err := fsutil.ListDirs(appDir)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]*vbase.BucketResponse, 0, len(names))
+	for _, name := range names {
+		info, err := fsutil.ReadBucket(filepath.Join(appDir, name))
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, &vbase.BucketResponse{Name: name, Hash: info.Hash, State: info.State})
+	}
+	return buckets, nil
+}
+
+// ListAllConflicts returns no conflicts, since a local directory has no
+// workspace merges
+func (b *backend) ListAllConflicts(bucket string) ([]*vbase.Conflict, error) {
+	return nil, nil
+}
+
+func (b *backend) ResolveConflicts(bucket string, patch vbase.PatchRequest) error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package vbase
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	gentleman "gopkg.in/h2non/gentleman.v1"
+)
+
+// ErrChecksumMismatch is returned when content doesn't match its ETag
+var ErrChecksumMismatch = errors.New("Content doesn't match its checksum")
+
+// ContentHash returns the hex encoded MD5 of content, the format used by
+// VBase in file ETags and listing hashes
+func ContentHash(content []byte) string {
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// eTagHash extracts the content MD5 from an ETag. It returns false for ETags
+// in other formats, which can't be verified.
+func eTagHash(eTag string) (string, bool) {
+	eTag = strings.Trim(strings.TrimPrefix(eTag, "W/"), `"`)
+	if len(eTag) != md5.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(eTag); err != nil {
+		return "", false
+	}
+	return strings.ToLower(eTag), true
+}
+
+// verifyingReader hashes the content read, failing at EOF if it doesn't
+// match the expected hash
+type verifyingReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func newVerifyingReader(rc io.ReadCloser, eTag string) io.ReadCloser {
+	expected, ok := eTagHash(eTag)
+	if !ok {
+		return rc
+	}
+	return &verifyingReader{rc, md5.New(), expected}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.expected {
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// uploadCheck verifies the ETag returned by an upload against the MD5 of the
+// body sent. Seekable bodies are hashed upfront so that their digest is also
+// sent to the server.
+type uploadCheck struct {
+	body       io.Reader
+	hash       hash.Hash
+	contentMD5 []byte
+}
+
+func (cl *client) newUploadCheck(body io.Reader, opts SaveFileOptions) (*uploadCheck, error) {
+	// The ETag of unzip uploads doesn't describe the uploaded archive
+	if !cl.verifyIntegrity || opts.Unzip {
+		return &uploadCheck{body: body}, nil
+	}
+
+	h := md5.New()
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		return &uploadCheck{body: io.TeeReader(body, h), hash: h}, nil
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, seeker); err != nil {
+		return nil, err
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &uploadCheck{body: body, hash: h, contentMD5: h.Sum(nil)}, nil
+}
+
+// newResumableCheck creates an uploadCheck for a resumable upload, whose
+// chunks are hashed as they are read, along with the bytes skipped when
+// resuming a session
+func (cl *client) newResumableCheck(opts SaveFileOptions) *uploadCheck {
+	if !cl.verifyIntegrity || opts.Unzip {
+		return &uploadCheck{}
+	}
+	return &uploadCheck{hash: md5.New()}
+}
+
+func (c *uploadCheck) setHeaders(req *gentleman.Request) *gentleman.Request {
+	if c.contentMD5 == nil {
+		return req
+	}
+	digest := base64.StdEncoding.EncodeToString(c.contentMD5)
+	return req.
+		SetHeader("Content-MD5", digest).
+		SetHeader("Digest", "md5="+digest)
+}
+
+func (c *uploadCheck) verify(eTag string) (string, error) {
+	if c.hash == nil {
+		return eTag, nil
+	}
+	if expected, ok := eTagHash(eTag); ok && expected != hex.EncodeToString(c.hash.Sum(nil)) {
+		return "", ErrChecksumMismatch
+	}
+	return eTag, nil
+}
@@ -0,0 +1,63 @@
+package vbase_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/vtex/go-clients/mocks"
+	"github.com/vtex/go-clients/vbase"
+)
+
+// corruptChunks flips the first byte of every chunk sent to an upload session
+type corruptChunks struct {
+	http.Handler
+}
+
+func (c corruptChunks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/uploads/") {
+		chunk, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(chunk) > 0 {
+			chunk[0] ^= 0xff
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(chunk))
+	}
+	c.Handler.ServeHTTP(w, r)
+}
+
+func TestResumableUploadDetectsETagMismatch(t *testing.T) {
+	fake := mocks.NewVBase()
+	client := newTestClient(t, corruptChunks{mocks.NewVBaseHandler(fake)}, vbase.ClientOptions{VerifyIntegrity: true})
+
+	_, err := client.Upload(context.Background(), "bucket", "file.txt", strings.NewReader("content"), vbase.UploadOptions{Resumable: true})
+	if err != vbase.ErrChecksumMismatch {
+		t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestGetFileDetectsCorruption(t *testing.T) {
+	fake := mocks.NewVBase()
+	client := newTestClient(t, mocks.NewVBaseHandler(fake), vbase.ClientOptions{VerifyIntegrity: true})
+	if _, err := fake.SaveFileB("bucket", "file.txt", []byte("content"), vbase.SaveFileOptions{ContentType: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	if !mocks.CorruptVBaseFile(fake, "bucket", "file.txt") {
+		t.Fatal("Expected the file to be corrupted")
+	}
+
+	rc, _, err := client.GetFile("bucket", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := ioutil.ReadAll(rc); err != vbase.ErrChecksumMismatch {
+		t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+	}
+}
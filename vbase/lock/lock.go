@@ -0,0 +1,296 @@
+// Package lock provides advisory distributed locks stored as lease documents
+// in VBase. Leases are written with conditional saves, so that only one owner
+// holds a lock at a time, and expire unless renewed, so that a crashed owner's
+// lock can be taken over.
+//
+// Locks depend on the clocks of their owners being roughly in sync. Since a
+// holder may be paused past its lease expiration, work guarded by a lock
+// should be checked against its fencing token.
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/vbase"
+)
+
+var (
+	// ErrLocked is returned by TryAcquire when the lock is held by someone else
+	ErrLocked = errors.New("Lock is held by another owner")
+	// ErrLockLost is returned when a lock's lease was taken over or couldn't be
+	// renewed before expiring
+	ErrLockLost = errors.New("Lock lease was lost")
+	// ErrReleased is returned when using a lock after releasing it
+	ErrReleased = errors.New("Lock was released")
+)
+
+// Lease is the document stored for each lock
+type Lease struct {
+	Owner string `json:"owner"`
+	// Token increases every time the lock is acquired, and may be sent along
+	// with guarded writes so that writes from stale holders are rejected.
+	Token   int64     `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Options configures a Locker
+type Options struct {
+	// Owner identifies the holder of locks acquired by the Locker. Defaults to
+	// a random ID.
+	Owner string
+	// Prefix is prepended to lock names to build their paths. Defaults to
+	// "locks/".
+	Prefix string
+	// RetryInterval is how often Acquire checks a held lock. Defaults to one
+	// second.
+	RetryInterval time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Locker acquires locks on behalf of a single owner
+type Locker struct {
+	client vbase.VBase
+	opts   Options
+}
+
+// NewLocker creates a Locker storing leases with client
+func NewLocker(client vbase.VBase, opts Options) (*Locker, error) {
+	if opts.Owner == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		opts.Owner = id.String()
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "locks/"
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Locker{client: client, opts: opts}, nil
+}
+
+// Lock is a held lock. Its lease is renewed in the background until it is
+// released or lost.
+type Lock struct {
+	locker *Locker
+	bucket string
+	path   string
+	ttl    time.Duration
+	token  int64
+
+	mu       sync.Mutex
+	eTag     string
+	err      error
+	lost     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Acquire blocks until the lock is acquired or ctx is done. Locks whose lease
+// expired are taken over.
+func (l *Locker) Acquire(ctx context.Context, bucket, name string, ttl time.Duration) (*Lock, error) {
+	for {
+		lock, wait, err := l.tryAcquire(bucket, name, ttl)
+		if err != ErrLocked {
+			return lock, err
+		}
+		if wait > l.opts.RetryInterval {
+			wait = l.opts.RetryInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// TryAcquire acquires the lock if it is free or its lease expired, failing
+// with ErrLocked otherwise.
+func (l *Locker) TryAcquire(bucket, name string, ttl time.Duration) (*Lock, error) {
+	lock, _, err := l.tryAcquire(bucket, name, ttl)
+	return lock, err
+}
+
+// tryAcquire returns ErrLocked and how long until the current lease expires
+// if the lock is held.
+func (l *Locker) tryAcquire(bucket, name string, ttl time.Duration) (*Lock, time.Duration, error) {
+	if ttl <= 0 {
+		return nil, 0, errors.Errorf("Invalid lock TTL %v", ttl)
+	}
+	path := l.opts.Prefix + name
+	now := l.opts.Now()
+
+	var current Lease
+	saveOpts := vbase.SaveFileOptions{ContentType: "application/json"}
+	eTag, err := l.client.GetJSON(bucket, path, &current)
+	if clients.IsNotFound(err) {
+		saveOpts.IfNoneMatch = "*"
+	} else if err != nil {
+		return nil, 0, err
+	} else if now.Before(current.Expires) {
+		return nil, current.Expires.Sub(now), ErrLocked
+	} else {
+		saveOpts.IfMatch = eTag
+	}
+
+	lease := Lease{Owner: l.opts.Owner, Token: current.Token + 1, Expires: now.Add(ttl)}
+	eTag, err = l.saveLease(bucket, path, lease, saveOpts)
+	if vbase.IsPreconditionFailed(err) {
+		// Another owner got it first
+		return nil, 0, ErrLocked
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	lock := &Lock{
+		locker: l,
+		bucket: bucket,
+		path:   path,
+		ttl:    ttl,
+		token:  lease.Token,
+		eTag:   eTag,
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go lock.renew()
+	return lock, 0, nil
+}
+
+func (l *Locker) saveLease(bucket, path string, lease Lease, opts vbase.SaveFileOptions) (string, error) {
+	content, err := json.Marshal(lease)
+	if err != nil {
+		return "", err
+	}
+	return l.client.SaveFileB(bucket, path, content, opts)
+}
+
+// Token is the fencing token of this acquisition of the lock
+func (k *Lock) Token() int64 {
+	return k.token
+}
+
+// Lost is closed when the lease is lost or released, after which Err returns
+// why
+func (k *Lock) Lost() <-chan struct{} {
+	return k.lost
+}
+
+// Err returns why the lease was lost or ErrReleased, or nil if it is still
+// held
+func (k *Lock) Err() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+// renew extends the lease every third of its TTL until stopped or lost.
+// Failed renewals are retried on the next tick, and the lease is given up a
+// sixth of its TTL before it expires, so that Lost is closed before another
+// owner may take it over.
+func (k *Lock) renew() {
+	defer close(k.done)
+
+	interval, margin := k.ttl/3, k.ttl/6
+	expires := k.locker.opts.Now().Add(k.ttl)
+	renewal := time.NewTimer(interval)
+	defer renewal.Stop()
+	deadline := time.NewTimer(expires.Sub(k.locker.opts.Now()) - margin)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-deadline.C:
+			k.fail(errors.Wrap(ErrLockLost, "Lease about to expire without being renewed"))
+			return
+		case <-renewal.C:
+		}
+
+		now := k.locker.opts.Now()
+		err := k.save(now.Add(k.ttl))
+		if vbase.IsPreconditionFailed(err) {
+			k.fail(errors.Wrap(ErrLockLost, err.Error()))
+			return
+		}
+		if err == nil {
+			expires = now.Add(k.ttl)
+			resetTimer(deadline, expires.Sub(k.locker.opts.Now())-margin)
+		}
+		renewal.Reset(interval)
+	}
+}
+
+// resetTimer resets a timer whose channel may hold an unread tick
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+func (k *Lock) save(expires time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.err != nil {
+		return k.err
+	}
+
+	lease := Lease{Owner: k.locker.opts.Owner, Token: k.token, Expires: expires}
+	eTag, err := k.locker.saveLease(k.bucket, k.path, lease, vbase.SaveFileOptions{
+		ContentType: "application/json",
+		IfMatch:     k.eTag,
+	})
+	if err != nil {
+		return err
+	}
+	k.eTag = eTag
+	return nil
+}
+
+func (k *Lock) fail(err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.err == nil {
+		k.err = err
+		close(k.lost)
+	}
+}
+
+// Release stops renewing the lease and expires it, keeping its token so that
+// the next holder gets a greater one. It returns ErrLockLost if the lease was
+// lost before being released.
+func (k *Lock) Release() error {
+	k.stopOnce.Do(func() { close(k.stop) })
+	<-k.done
+
+	if err := k.save(time.Time{}); err != nil {
+		if vbase.IsPreconditionFailed(err) {
+			err = ErrLockLost
+		}
+		k.fail(err)
+		return err
+	}
+	k.fail(ErrReleased)
+	return nil
+}
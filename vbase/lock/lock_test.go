@@ -0,0 +1,140 @@
+package lock_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vtex/go-clients/mocks"
+	"github.com/vtex/go-clients/vbase"
+	"github.com/vtex/go-clients/vbase/lock"
+)
+
+// clock is a manually advanced time source
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newLocker(t *testing.T, client vbase.VBase, owner string, now func() time.Time) *lock.Locker {
+	locker, err := lock.NewLocker(client, lock.Options{Owner: owner, Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return locker
+}
+
+func TestTakeOverStaleLease(t *testing.T) {
+	fake := mocks.NewVBase()
+	clk := &clock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := newLocker(t, fake, "a", clk.Now)
+	b := newLocker(t, fake, "b", clk.Now)
+
+	first, err := a.TryAcquire("bucket", "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.TryAcquire("bucket", "job", time.Minute); err != lock.ErrLocked {
+		t.Fatalf("Expected ErrLocked while the lease is valid, got %v", err)
+	}
+
+	clk.Advance(2 * time.Minute)
+	second, err := b.TryAcquire("bucket", "job", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected the stale lease to be taken over, got %v", err)
+	}
+	defer second.Release()
+	if second.Token() <= first.Token() {
+		t.Errorf("Expected token %d to be greater than %d", second.Token(), first.Token())
+	}
+
+	if err := first.Release(); err != lock.ErrLockLost {
+		t.Errorf("Expected releasing a lock taken over to fail with ErrLockLost, got %v", err)
+	}
+	select {
+	case <-first.Lost():
+	default:
+		t.Error("Expected Lost to be closed after the lease was taken over")
+	}
+}
+
+func TestFencingTokensIncrease(t *testing.T) {
+	fake := mocks.NewVBase()
+	locker := newLocker(t, fake, "owner", nil)
+
+	var last int64
+	for i := 0; i < 3; i++ {
+		l, err := locker.TryAcquire("bucket", "job", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Token() <= last {
+			t.Errorf("Expected token %d to be greater than %d", l.Token(), last)
+		}
+		last = l.Token()
+		if err := l.Release(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Release(); err != lock.ErrReleased {
+			t.Errorf("Expected releasing twice to fail with ErrReleased, got %v", err)
+		}
+	}
+}
+
+// failingSaves fails every save once failing is set
+type failingSaves struct {
+	vbase.VBase
+
+	mu      sync.Mutex
+	failing bool
+}
+
+func (f *failingSaves) SaveFileB(bucket, path string, content []byte, opts vbase.SaveFileOptions) (string, error) {
+	f.mu.Lock()
+	failing := f.failing
+	f.mu.Unlock()
+	if failing {
+		return "", errors.New("Unavailable")
+	}
+	return f.VBase.SaveFileB(bucket, path, content, opts)
+}
+
+func TestLostBeforeLeaseExpires(t *testing.T) {
+	client := &failingSaves{VBase: mocks.NewVBase()}
+	locker := newLocker(t, client, "owner", nil)
+
+	ttl := 300 * time.Millisecond
+	acquired := time.Now()
+	l, err := locker.TryAcquire("bucket", "job", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.mu.Lock()
+	client.failing = true
+	client.mu.Unlock()
+
+	select {
+	case <-l.Lost():
+	case <-time.After(2 * ttl):
+		t.Fatal("Expected the lease to be lost")
+	}
+	if lost := time.Now(); !lost.Before(acquired.Add(ttl)) {
+		t.Errorf("Expected the lease to be lost before expiring, lost after %v", lost.Sub(acquired))
+	}
+	if errors.Cause(l.Err()) != lock.ErrLockLost {
+		t.Errorf("Expected ErrLockLost, got %v", l.Err())
+	}
+}
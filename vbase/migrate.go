@@ -0,0 +1,187 @@
+package vbase
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vtex/go-clients/clients"
+)
+
+// ErrSkipFile is returned by a migration Transform to leave a file out
+var ErrSkipFile = errors.New("Skip file")
+
+// MigrateFile is a file being migrated. Transform functions may change its
+// path, content type and content.
+type MigrateFile struct {
+	Path        string
+	ContentType string
+	Content     []byte
+}
+
+// MigrateOptions configures Migrate
+type MigrateOptions struct {
+	// DstBucket is the destination bucket. Defaults to the source bucket.
+	DstBucket string
+	// Prefix restricts the migration to files under a path prefix
+	Prefix string
+	// Transform, if set, is called with every file before it is saved. It
+	// may return ErrSkipFile to leave the file out; other errors are recorded
+	// in the report and the file is skipped.
+	Transform func(file *MigrateFile) error
+	// BatchSize is the number of files listed at once. Defaults to 100.
+	BatchSize int
+	// Concurrency is the maximum number of simultaneous copies. Defaults to 4.
+	Concurrency int
+	// Marker resumes a migration from a marker passed to OnCheckpoint
+	Marker string
+	// OnCheckpoint, if set, is called after each batch is saved with the
+	// marker to resume from, empty when the migration is complete. Failing
+	// stops the migration.
+	OnCheckpoint func(marker string) error
+	// DryRun reads and transforms files without saving them
+	DryRun bool
+}
+
+// MigrateFailure is a file that couldn't be transformed
+type MigrateFailure struct {
+	Path string
+	Err  error
+}
+
+// MigrateReport summarizes a migration
+type MigrateReport struct {
+	Read int
+	// Written counts the files saved, or that would be saved in a dry run
+	Written  int
+	Skipped  int
+	Bytes    int64
+	Failures []MigrateFailure
+	// Marker resumes the migration when it stopped early
+	Marker   string
+	Duration time.Duration
+}
+
+func (r *MigrateReport) String() string {
+	return fmt.Sprintf("%d read, %d written (%d bytes), %d skipped, %d failed in %v", r.Read, r.Written, r.Bytes, r.Skipped, len(r.Failures), r.Duration)
+}
+
+// Migrate copies the files of bucket from src to dst, e.g. clients created
+// for different apps, workspaces or accounts. Files are listed in batches and
+// copied concurrently within each batch.
+func Migrate(src, dst VBase, bucket string, opts MigrateOptions) (*MigrateReport, error) {
+	if opts.DstBucket == "" {
+		opts.DstBucket = bucket
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+
+	start := time.Now()
+	report := &MigrateReport{Marker: opts.Marker}
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+
+	for {
+		list, _, err := src.ListFiles(bucket, &Options{Prefix: opts.Prefix, Limit: opts.BatchSize, Marker: report.Marker})
+		if err != nil {
+			return report, err
+		}
+		if err := migrateBatch(src, dst, bucket, list.Files, opts, report); err != nil {
+			return report, err
+		}
+
+		next := list.NextMarker
+		if len(list.Files) == 0 {
+			next = ""
+		}
+		if opts.OnCheckpoint != nil && !opts.DryRun {
+			if err := opts.OnCheckpoint(next); err != nil {
+				return report, err
+			}
+		}
+		report.Marker = next
+		if next == "" {
+			return report, nil
+		}
+	}
+}
+
+func migrateBatch(src, dst VBase, bucket string, files []*FileEntryResponse, opts MigrateOptions, report *MigrateReport) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	sem := make(chan struct{}, opts.Concurrency)
+	for _, f := range files {
+		path := f.Path
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			file, err := readMigrateFile(src, bucket, path)
+			var transformErr error
+			if err == nil && opts.Transform != nil {
+				transformErr = opts.Transform(file)
+			}
+			if err == nil && transformErr == nil && !opts.DryRun {
+				_, err = dst.SaveFileB(opts.DstBucket, file.Path, file.Content, SaveFileOptions{ContentType: file.ContentType})
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Read++
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+			case transformErr == ErrSkipFile:
+				report.Skipped++
+			case transformErr != nil:
+				report.Failures = append(report.Failures, MigrateFailure{path, transformErr})
+			default:
+				report.Written++
+				report.Bytes += int64(len(file.Content))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Error(s) migrating bucket %s: %s", bucket, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func readMigrateFile(client VBase, bucket, path string) (*MigrateFile, error) {
+	body, contentType, err := client.GetFile(bucket, path)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return &MigrateFile{Path: path, ContentType: contentType, Content: content}, nil
+}
+
+// MigrateApp copies a bucket of srcApp to dstApp, e.g. after an app is
+// renamed, using the account and workspace in config
+func MigrateApp(config *clients.Config, srcApp, dstApp, bucket string, opts MigrateOptions) (*MigrateReport, error) {
+	src := NewCustomAppClient(srcApp, config, nil)
+	dst := NewCustomAppClient(dstApp, config, nil)
+	return Migrate(src, dst, bucket, opts)
+}
@@ -0,0 +1,117 @@
+package vbase
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ReplayPolicy controls how request bodies are kept to retry requests after
+// conflicts are resolved.
+type ReplayPolicy struct {
+	// MaxMemory is how many bytes of a body are kept in memory. Defaults to 4MB.
+	MaxMemory int64
+	// Spill writes bodies larger than MaxMemory to a temporary file, so that
+	// they can be replayed. Otherwise, retrying them fails.
+	Spill bool
+	// TempDir is where spilled bodies are written. Defaults to os.TempDir().
+	TempDir string
+}
+
+var defaultReplayPolicy = ReplayPolicy{MaxMemory: 4 << 20}
+
+// replayableBody records a request body while it is sent, so that the same
+// content can be sent again.
+type replayableBody struct {
+	src      io.ReadCloser
+	policy   ReplayPolicy
+	mem      bytes.Buffer
+	spill    *os.File
+	tooLarge bool
+}
+
+func newReplayableBody(src io.ReadCloser, policy ReplayPolicy) *replayableBody {
+	if policy.MaxMemory <= 0 {
+		policy.MaxMemory = defaultReplayPolicy.MaxMemory
+	}
+	return &replayableBody{src: src, policy: policy}
+}
+
+func (b *replayableBody) Read(p []byte) (int, error) {
+	n, err := b.src.Read(p)
+	if n > 0 {
+		if recErr := b.record(p[:n]); recErr != nil {
+			return n, recErr
+		}
+	}
+	return n, err
+}
+
+// Close is a no-op, since the body may still be replayed after the transport
+// is done with it. Resources are released by discard.
+func (b *replayableBody) Close() error {
+	return nil
+}
+
+func (b *replayableBody) record(p []byte) error {
+	if b.tooLarge {
+		return nil
+	}
+	if b.spill == nil && int64(b.mem.Len()+len(p)) <= b.policy.MaxMemory {
+		b.mem.Write(p)
+		return nil
+	}
+	if !b.policy.Spill {
+		b.tooLarge = true
+		b.mem.Reset()
+		return nil
+	}
+	if b.spill == nil {
+		var err error
+		if b.spill, err = ioutil.TempFile(b.policy.TempDir, "vbase-body-"); err != nil {
+			return err
+		}
+	}
+	_, err := b.spill.Write(p)
+	return err
+}
+
+// Replay returns a reader with the whole body content, including any part
+// the transport didn't read. Closing it releases the recorded content.
+func (b *replayableBody) Replay() (io.ReadCloser, error) {
+	if _, err := io.Copy(ioutil.Discard, b); err != nil {
+		b.discard()
+		return nil, err
+	}
+	if b.tooLarge {
+		b.discard()
+		return nil, fmt.Errorf("Request body larger than %d bytes can't be replayed", b.policy.MaxMemory)
+	}
+
+	readers := []io.Reader{bytes.NewReader(b.mem.Bytes())}
+	if b.spill != nil {
+		readers = append(readers, io.NewSectionReader(b.spill, 0, 1<<62))
+	}
+	return &replayReader{io.MultiReader(readers...), b}, nil
+}
+
+func (b *replayableBody) discard() {
+	b.src.Close()
+	if b.spill != nil {
+		b.spill.Close()
+		os.Remove(b.spill.Name())
+		b.spill = nil
+	}
+}
+
+type replayReader struct {
+	io.Reader
+	body *replayableBody
+}
+
+func (r *replayReader) Close() error {
+	r.body.discard()
+	return nil
+}
@@ -1,11 +1,23 @@
 package vbase
 
-import "encoding/json"
+import (
+	"encoding/json"
 
-// BucketResponse is the description of a bucket's state
+	"github.com/vtex/go-clients/common"
+)
+
+// BucketResponse is the description of a bucket's state. Name is only set in
+// bucket listings.
 type BucketResponse struct {
-	Hash  string `json:"hash"`
-	State string `json:"state"`
+	Name  string             `json:"name,omitempty"`
+	Hash  string             `json:"hash"`
+	State common.BucketState `json:"state"`
+}
+
+// BucketListResponse is the description of a page of buckets
+type BucketListResponse struct {
+	Buckets    []*BucketResponse `json:"data"`
+	NextMarker string            `json:"next"`
 }
 
 // FileEntryResponse is the description of an entry in a FileListResponse
@@ -0,0 +1,144 @@
+package vbase
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/vtex/go-clients/internal/fsutil"
+)
+
+// zipEpoch is the modification time of every archived file, so that the
+// archive of a same tree is always the same
+var zipEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type SaveTreeOptions struct {
+	// Include and Exclude are glob patterns (see path.Match) matched against
+	// the slash separated path of each file. Patterns without a slash are also
+	// matched against the file's base name. When Include is empty, every file
+	// is included.
+	Include []string
+	Exclude []string
+	// MaxArchiveSize is the largest total size of the files sent in a single
+	// archive. Larger trees are uploaded one file at a time. It also bounds the
+	// memory kept to retry uploads after conflicts. Defaults to 64MB.
+	MaxArchiveSize int64
+	// IgnoreConflicts skips conflict detection, as in SaveFileOptions
+	IgnoreConflicts bool
+}
+
+// SaveTree uploads the files in fsys to bucket under prefix. The files are
+// zipped while being sent and extracted by VBase, without temporary files: the
+// bodies kept to retry uploads after conflicts are resolved are bounded to
+// MaxArchiveSize, and larger ones fail instead of spilling to disk.
+func SaveTree(ctx context.Context, client VBase, bucket, prefix string, fsys fs.FS, opts SaveTreeOptions) error {
+	if opts.MaxArchiveSize <= 0 {
+		opts.MaxArchiveSize = 64 << 20
+	}
+	replay := ReplayPolicy{MaxMemory: opts.MaxArchiveSize}
+
+	var files []string
+	var total int64
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !fsutil.MatchPath(opts.Include, opts.Exclude, name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, name)
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	if total > opts.MaxArchiveSize {
+		return saveTreeFiles(ctx, client, bucket, prefix, fsys, files, opts, replay)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeZip(pw, fsys, files))
+	}()
+	_, err = client.Upload(ctx, bucket, strings.TrimSuffix(prefix, "/"), pr, UploadOptions{
+		SaveFileOptions: SaveFileOptions{
+			ContentType:     "application/zip",
+			Unzip:           true,
+			IgnoreConflicts: opts.IgnoreConflicts,
+		},
+		Replay: replay,
+	})
+	// Unblocks the writer if the upload failed before reading the whole archive
+	pr.CloseWithError(fmt.Errorf("Upload finished"))
+	return err
+}
+
+func writeZip(w io.Writer, fsys fs.FS, files []string) error {
+	zw := zip.NewWriter(w)
+	for _, name := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: zipEpoch,
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyFile(fw, fsys, name); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func copyFile(w io.Writer, fsys fs.FS, name string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func saveTreeFiles(ctx context.Context, client VBase, bucket, prefix string, fsys fs.FS, files []string, opts SaveTreeOptions, replay ReplayPolicy) error {
+	for _, name := range files {
+		if err := saveTreeFile(ctx, client, bucket, path.Join(prefix, name), fsys, name, opts, replay); err != nil {
+			return fmt.Errorf("Error saving %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func saveTreeFile(ctx context.Context, client VBase, bucket, filePath string, fsys fs.FS, name string, opts SaveTreeOptions, replay ReplayPolicy) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = client.Upload(ctx, bucket, filePath, f, UploadOptions{
+		SaveFileOptions: SaveFileOptions{
+			ContentType:     mime.TypeByExtension(path.Ext(name)),
+			IgnoreConflicts: opts.IgnoreConflicts,
+		},
+		Replay: replay,
+	})
+	return err
+}
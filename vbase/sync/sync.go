@@ -0,0 +1,352 @@
+// Package sync mirrors local directories to VBase buckets and back, only
+// transferring files whose content hash differs between both sides.
+package sync
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+
+	"github.com/vtex/go-clients/internal/fsutil"
+	"github.com/vtex/go-clients/vbase"
+)
+
+// ActionType is the kind of change applied to a single file
+type ActionType string
+
+const (
+	ActionUpload   = ActionType("upload")
+	ActionDownload = ActionType("download")
+	ActionDelete   = ActionType("delete")
+)
+
+// Action describes a file transfer or deletion planned by a sync
+type Action struct {
+	Type ActionType
+	// Path is the file path inside the bucket
+	Path string
+	// LocalPath is the file path in the local filesystem
+	LocalPath string
+	// Remote is true if the action affects the bucket, false if it affects
+	// the local directory
+	Remote bool
+	Err    error
+}
+
+// Progress is reported after each action finishes
+type Progress struct {
+	Action *Action
+	Done   int
+	Total  int
+}
+
+// Options configures a Syncer
+type Options struct {
+	// Concurrency is the maximum number of simultaneous transfers. Defaults to 4.
+	Concurrency int
+	// Delete removes files from the destination that don't exist in the source.
+	Delete bool
+	// Include and Exclude are glob patterns (see path.Match) matched against
+	// the slash separated relative path of each file. Patterns without a slash
+	// are also matched against the file's base name. When Include is empty,
+	// every file is included.
+	Include []string
+	Exclude []string
+	// DryRun plans the sync without transferring or deleting anything.
+	DryRun bool
+	// Progress, if set, is called after each action. Calls are serialized.
+	Progress func(Progress)
+	// Hash computes the hash of a file's content, which must be comparable to
+	// vbase.FileEntryResponse.Hash. Defaults to MD5Hash.
+	Hash func(r io.Reader) (string, error)
+}
+
+// Result summarizes a sync
+type Result struct {
+	Actions   []*Action
+	Unchanged int
+	DryRun    bool
+}
+
+// Syncer synchronizes local directories with VBase buckets
+type Syncer struct {
+	client vbase.VBase
+	opts   Options
+}
+
+// NewSyncer creates a Syncer on top of a VBase client
+func NewSyncer(client vbase.VBase, opts Options) *Syncer {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	if opts.Hash == nil {
+		opts.Hash = MD5Hash
+	}
+	return &Syncer{client, opts}
+}
+
+// MD5Hash returns the hex encoded MD5 of the content read from r
+func MD5Hash(r io.Reader) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Push uploads the files in localDir to bucket under prefix
+func (s *Syncer) Push(localDir, bucket, prefix string) (*Result, error) {
+	local, err := s.listLocal(localDir)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := s.listRemote(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{DryRun: s.opts.DryRun}
+	for _, rel := range sortedKeys(local) {
+		localPath := local[rel]
+		remotePath := joinPrefix(prefix, rel)
+		if hash, ok := remote[rel]; ok {
+			if localHash, err := s.hashFile(localPath); err != nil {
+				return nil, err
+			} else if localHash == hash {
+				result.Unchanged++
+				continue
+			}
+		}
+		result.Actions = append(result.Actions, &Action{Type: ActionUpload, Path: remotePath, LocalPath: localPath, Remote: true})
+	}
+	if s.opts.Delete {
+		for _, rel := range sortedKeys(remote) {
+			if _, ok := local[rel]; !ok {
+				result.Actions = append(result.Actions, &Action{Type: ActionDelete, Path: joinPrefix(prefix, rel), Remote: true})
+			}
+		}
+	}
+
+	return result, s.run(result.Actions, func(a *Action) error {
+		if a.Type == ActionDelete {
+			return s.client.DeleteFile(bucket, a.Path)
+		}
+		return s.upload(bucket, a)
+	})
+}
+
+// Pull downloads the files in bucket under prefix to localDir
+func (s *Syncer) Pull(bucket, prefix, localDir string) (*Result, error) {
+	remote, err := s.listRemote(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	local, err := s.listLocal(localDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	result := &Result{DryRun: s.opts.DryRun}
+	for _, rel := range sortedKeys(remote) {
+		localPath, err := joinLocal(localDir, rel)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := local[rel]; ok {
+			if localHash, err := s.hashFile(localPath); err != nil {
+				return nil, err
+			} else if localHash == remote[rel] {
+				result.Unchanged++
+				continue
+			}
+		}
+		result.Actions = append(result.Actions, &Action{Type: ActionDownload, Path: joinPrefix(prefix, rel), LocalPath: localPath})
+	}
+	if s.opts.Delete {
+		for _, rel := range sortedKeys(local) {
+			if _, ok := remote[rel]; !ok {
+				result.Actions = append(result.Actions, &Action{Type: ActionDelete, Path: joinPrefix(prefix, rel), LocalPath: local[rel]})
+			}
+		}
+	}
+
+	return result, s.run(result.Actions, func(a *Action) error {
+		if a.Type == ActionDelete {
+			return os.Remove(a.LocalPath)
+		}
+		return s.download(bucket, a)
+	})
+}
+
+// joinLocal returns the local path of a remote file, rejecting paths that
+// would escape localDir, e.g. absolute ones or ones with ".." segments
+func joinLocal(localDir, rel string) (string, error) {
+	name := filepath.FromSlash(path.Clean(rel))
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("Invalid remote file path %s", rel)
+	}
+	return filepath.Join(localDir, name), nil
+}
+
+func (s *Syncer) upload(bucket string, a *Action) error {
+	f, err := os.Open(a.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = s.client.SaveFile(bucket, a.Path, f, vbase.SaveFileOptions{
+		ContentType: mime.TypeByExtension(path.Ext(a.Path)),
+	})
+	return err
+}
+
+func (s *Syncer) download(bucket string, a *Action) error {
+	file, _, err := s.client.GetFile(bucket, a.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dir := filepath.Dir(a.LocalPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".vbase-sync-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, file); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.LocalPath)
+}
+
+func (s *Syncer) run(actions []*Action, do func(a *Action) error) error {
+	var (
+		wg   gosync.WaitGroup
+		mu   gosync.Mutex
+		done int
+		errs []string
+	)
+	sem := make(chan struct{}, s.opts.Concurrency)
+	for _, a := range actions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(a *Action) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if !s.opts.DryRun {
+				a.Err = do(a)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			if a.Err != nil {
+				errs = append(errs, fmt.Sprintf("%s %s: %v", a.Type, a.Path, a.Err))
+			}
+			if s.opts.Progress != nil {
+				s.opts.Progress(Progress{Action: a, Done: done, Total: len(actions)})
+			}
+		}(a)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Error(s) syncing %d of %d files: %s", len(errs), len(actions), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// listRemote returns the hash of each file in the bucket under prefix, keyed
+// by its path relative to prefix.
+func (s *Syncer) listRemote(bucket, prefix string) (map[string]string, error) {
+	dirPrefix := joinPrefix(prefix, "")
+	list, _, err := s.client.ListAllFiles(bucket, dirPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string, len(list.Files))
+	for _, f := range list.Files {
+		if !strings.HasPrefix(f.Path, dirPrefix) {
+			continue
+		}
+		if rel := strings.TrimPrefix(f.Path, dirPrefix); s.matches(rel) {
+			files[rel] = f.Hash
+		}
+	}
+	return files, nil
+}
+
+// listLocal returns the path of each regular file under dir, keyed by its
+// slash separated path relative to dir.
+func (s *Syncer) listLocal(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); s.matches(rel) {
+			files[rel] = p
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (s *Syncer) hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return s.opts.Hash(f)
+}
+
+func (s *Syncer) matches(rel string) bool {
+	return fsutil.MatchPath(s.opts.Include, s.opts.Exclude, rel)
+}
+
+func joinPrefix(prefix, rel string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return rel
+	}
+	return prefix + "/" + rel
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package vbase
+
+import (
+	"encoding/json"
+
+	"github.com/vtex/go-clients/codec"
+	"github.com/vtex/go-clients/internal/typed"
+)
+
+// TypedStoreOptions configures a TypedStore
+type TypedStoreOptions[T any] struct {
+	// Codec serializes values. Defaults to codec.JSON.
+	Codec codec.Codec
+	// Validate, if set, is called with every value before it is saved
+	Validate func(key string, value T) error
+}
+
+// TypedStore stores values of type T as files in a VBase bucket
+type TypedStore[T any] struct {
+	client VBase
+	bucket string
+	store  typed.Store[T]
+}
+
+// NewTypedStore creates a TypedStore over a bucket
+func NewTypedStore[T any](client VBase, bucket string, opts TypedStoreOptions[T]) *TypedStore[T] {
+	if opts.Codec == nil {
+		opts.Codec = codec.JSON
+	}
+	return &TypedStore[T]{client, bucket, typed.Store[T]{
+		Backend:  typedBackend{client, bucket},
+		Codec:    opts.Codec,
+		Validate: opts.Validate,
+	}}
+}
+
+// Get decodes the value stored at key
+func (s *TypedStore[T]) Get(key string) (T, string, error) {
+	return s.store.Get(key)
+}
+
+// Put validates and saves value at key
+func (s *TypedStore[T]) Put(key string, value T) (string, error) {
+	return s.store.Put(key, value)
+}
+
+// Delete removes the value at key
+func (s *TypedStore[T]) Delete(key string) error {
+	return s.client.DeleteFile(s.bucket, key)
+}
+
+// List calls fn with every value whose key starts with prefix, stopping at
+// the first error returned by fn. Values missing from the listing are fetched
+// individually.
+func (s *TypedStore[T]) List(prefix string, fn func(key string, value T) error) error {
+	options := &Options{Prefix: prefix, Limit: 100}
+	for {
+		list, _, err := s.client.ListFiles(s.bucket, options)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range list.Files {
+			var value T
+			if len(f.Value) == 0 {
+				value, _, err = s.Get(f.Path)
+			} else {
+				value, err = s.store.Decode(f.Value)
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(f.Path, value); err != nil {
+				return err
+			}
+		}
+
+		if list.NextMarker == "" {
+			return nil
+		}
+		options.Marker = list.NextMarker
+	}
+}
+
+// Update reads the value at key, applies mutate and saves the result only if
+// the file didn't change meanwhile, retrying with the new value otherwise. The
+// exists argument of mutate is false if there was no value at key.
+func (s *TypedStore[T]) Update(key string, mutate func(value T, exists bool) (T, error)) (T, string, error) {
+	return s.store.Update(key, mutate)
+}
+
+type typedBackend struct {
+	client VBase
+	bucket string
+}
+
+func (b typedBackend) Get(key string) (json.RawMessage, string, error) {
+	var raw json.RawMessage
+	eTag, err := b.client.GetJSON(b.bucket, key, &raw)
+	return raw, eTag, err
+}
+
+// Save uses SaveJSON for unconditional saves, so that the client's
+// compression and schemas apply
+func (b typedBackend) Save(key string, raw json.RawMessage, cond typed.Condition) (string, error) {
+	if cond == (typed.Condition{}) {
+		return b.client.SaveJSON(b.bucket, key, raw)
+	}
+	opts := SaveFileOptions{ContentType: "application/json", IfMatch: cond.IfMatch}
+	if cond.IfNotExists {
+		opts.IfNoneMatch = "*"
+	}
+	return b.client.SaveFileB(b.bucket, key, raw, opts)
+}
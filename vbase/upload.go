@@ -0,0 +1,228 @@
+package vbase
+
+import (
+	"bytes"
+	goContext "context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/vtex/go-clients/clients"
+	gentleman "gopkg.in/h2non/gentleman.v1"
+)
+
+const (
+	pathToUploads        = "/buckets/%v/%v/uploads"
+	pathToUpload         = "/buckets/%v/%v/uploads/%v"
+	pathToUploadComplete = "/buckets/%v/%v/uploads/%v/complete"
+)
+
+type UploadOptions struct {
+	SaveFileOptions
+	// Size is the body size, if known, reported as total to Progress
+	Size int64
+	// Progress, if set, is called as the body is sent
+	Progress func(sent, total int64)
+	// Replay controls how the body is kept to retry the upload after
+	// conflicts are resolved. Ignored in resumable mode.
+	Replay ReplayPolicy
+	// Timeout bounds the whole upload, including every request of a resumable
+	// upload, replacing the client's per request timeout. Zero means no limit
+	// other than the context's.
+	Timeout time.Duration
+
+	// Resumable uploads the body in chunks through an upload session
+	Resumable bool
+	// ChunkSize is the size of each chunk in resumable mode. Defaults to 8MB.
+	ChunkSize int64
+	// Session is the resumable upload session. If its ID is set, the upload
+	// resumes from the offset stored by the server, skipping as many bytes
+	// from the body. Otherwise, it is filled in as soon as a session is
+	// created, so that it can be persisted to resume a failed upload.
+	Session *UploadSession
+}
+
+// UploadSession is the server side state of a resumable upload
+type UploadSession struct {
+	ID          string `json:"id"`
+	Path        string `json:"path"`
+	ContentType string `json:"contentType,omitempty"`
+	Unzip       bool   `json:"unzip"`
+	Offset      int64  `json:"offset"`
+}
+
+// Upload saves a file to a workspace, streaming its body and reporting its
+// progress
+func (cl *client) Upload(ctx goContext.Context, bucket, path string, body io.Reader, opts UploadOptions) (string, error) {
+	if opts.Timeout > 0 {
+		var cancel goContext.CancelFunc
+		ctx, cancel = goContext.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	if opts.Resumable {
+		return cl.uploadResumable(ctx, bucket, path, body, opts)
+	}
+
+	check, err := cl.newUploadCheck(body, opts.SaveFileOptions)
+	if err != nil {
+		return "", err
+	}
+
+	req := transferRequest(cl.http.Put(), ctx, opts.Timeout).
+		AddPath(fmt.Sprintf(pathToFile, cl.appName, bucket, path)).
+		SetQuery("unzip", fmt.Sprintf("%v", opts.Unzip)).
+		Body(&progressReader{r: check.body, total: opts.Size, fn: opts.Progress})
+	if opts.ContentType != "" {
+		req = req.SetHeader("Content-Type", opts.ContentType)
+	}
+	req = check.setHeaders(req)
+	req = setConditionHeaders(req, opts.SaveFileOptions)
+
+	if !opts.IgnoreConflicts {
+		req = req.Use(cl.conflictHandlerWithPolicy(bucket, opts.Replay))
+	}
+
+	res, err := req.Send()
+	if err != nil {
+		return "", err
+	}
+	return check.verify(res.Header.Get(clients.HeaderETag))
+}
+
+func (cl *client) uploadResumable(ctx goContext.Context, bucket, path string, body io.Reader, opts UploadOptions) (string, error) {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 8 << 20
+	}
+	session := opts.Session
+	if session == nil {
+		session = &UploadSession{}
+	}
+	check := cl.newResumableCheck(opts.SaveFileOptions)
+
+	if session.ID == "" {
+		req := transferRequest(cl.http.Post(), ctx, opts.Timeout).
+			AddPath(fmt.Sprintf(pathToUploads, cl.appName, bucket)).
+			JSON(&UploadSession{Path: path, ContentType: opts.ContentType, Unzip: opts.Unzip})
+		if err := cl.sendUploadRequest(req, bucket, session, opts); err != nil {
+			return "", err
+		}
+	} else {
+		req := transferRequest(cl.http.Get(), ctx, opts.Timeout).
+			AddPath(fmt.Sprintf(pathToUpload, cl.appName, bucket, session.ID))
+		if err := cl.sendUploadRequest(req, bucket, session, opts); err != nil {
+			return "", err
+		}
+		if session.Offset < 0 || (opts.Size > 0 && session.Offset > opts.Size) {
+			return "", fmt.Errorf("Invalid offset %d of upload session %s", session.Offset, session.ID)
+		}
+		if check.hash != nil {
+			// Skipped bytes are read to verify the whole file's ETag
+			if _, err := io.CopyN(check.hash, body, session.Offset); err != nil {
+				return "", err
+			}
+		} else if err := skip(body, session.Offset); err != nil {
+			return "", err
+		}
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(session.Offset, opts.Size)
+	}
+
+	buf := make([]byte, opts.ChunkSize)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			if check.hash != nil {
+				check.hash.Write(buf[:n])
+			}
+			if err := cl.uploadChunk(ctx, bucket, session, buf[:n], opts); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	req := transferRequest(cl.http.Post(), ctx, opts.Timeout).
+		AddPath(fmt.Sprintf(pathToUploadComplete, cl.appName, bucket, session.ID))
+	req = setConditionHeaders(req, opts.SaveFileOptions)
+	if !opts.IgnoreConflicts {
+		req = req.Use(cl.conflictHandler(bucket))
+	}
+	res, err := req.Send()
+	if err != nil {
+		return "", err
+	}
+	return check.verify(res.Header.Get(clients.HeaderETag))
+}
+
+// uploadChunk sends chunk at the session's offset, sending again the part the
+// server didn't store, if any. The offset returned by the server must move
+// forward, up to the end of the chunk.
+func (cl *client) uploadChunk(ctx goContext.Context, bucket string, session *UploadSession, chunk []byte, opts UploadOptions) error {
+	for len(chunk) > 0 {
+		offset := session.Offset
+		req := transferRequest(cl.http.Put(), ctx, opts.Timeout).
+			AddPath(fmt.Sprintf(pathToUpload, cl.appName, bucket, session.ID)).
+			SetQuery("offset", strconv.FormatInt(offset, 10)).
+			Body(&progressReader{r: bytes.NewReader(chunk), sent: offset, total: opts.Size, fn: opts.Progress})
+		if err := cl.sendUploadRequest(req, bucket, session, opts); err != nil {
+			return err
+		}
+		if session.Offset <= offset || session.Offset > offset+int64(len(chunk)) {
+			return fmt.Errorf("Invalid offset %d of upload session %s after sending %d bytes at %d", session.Offset, session.ID, len(chunk), offset)
+		}
+		chunk = chunk[session.Offset-offset:]
+	}
+	return nil
+}
+
+// sendUploadRequest sends a request to the upload session endpoints, updating
+// session with the server's response.
+func (cl *client) sendUploadRequest(req *gentleman.Request, bucket string, session *UploadSession, opts UploadOptions) error {
+	if !opts.IgnoreConflicts {
+		req = req.Use(cl.conflictHandlerWithPolicy(bucket, ReplayPolicy{MaxMemory: opts.ChunkSize}))
+	}
+	res, err := req.Send()
+	if err != nil {
+		return err
+	}
+	return res.JSON(session)
+}
+
+// skip discards the first n bytes of r, seeking if possible
+func skip(r io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, n)
+	return err
+}
+
+type progressReader struct {
+	r     io.Reader
+	sent  int64
+	total int64
+	fn    func(sent, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.sent += int64(n)
+		if p.fn != nil {
+			p.fn(p.sent, p.total)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,97 @@
+package vbase_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vtex/go-clients/clients"
+	"github.com/vtex/go-clients/mocks"
+	"github.com/vtex/go-clients/vbase"
+)
+
+// newTestClient returns a client talking to handler over HTTP
+func newTestClient(t *testing.T, handler http.Handler, opts vbase.ClientOptions) vbase.VBase {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := vbase.NewClientWithOptions(&clients.Config{
+		Account:   "account",
+		Workspace: "master",
+		Endpoint:  server.URL,
+		UserAgent: "test-app/1.0.0",
+	}, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// failChunk fails the nth chunk sent to an upload session, once
+type failChunk struct {
+	http.Handler
+	n int
+
+	mu   sync.Mutex
+	seen int
+}
+
+func (f *failChunk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/uploads/") {
+		f.mu.Lock()
+		f.seen++
+		fail := f.seen == f.n
+		f.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	f.Handler.ServeHTTP(w, r)
+}
+
+func TestResumableUploadResumesAfterFailure(t *testing.T) {
+	fake := mocks.NewVBase()
+	client := newTestClient(t, &failChunk{Handler: mocks.NewVBaseHandler(fake), n: 2}, vbase.ClientOptions{VerifyIntegrity: true})
+	content := []byte("0123456789abcdef")
+	session := &vbase.UploadSession{}
+	opts := vbase.UploadOptions{Resumable: true, ChunkSize: 4, Session: session}
+
+	if _, err := client.Upload(context.Background(), "bucket", "file.txt", bytes.NewReader(content), opts); err == nil {
+		t.Fatal("Expected the upload to fail on its second chunk")
+	}
+	if session.ID == "" || session.Offset != 4 {
+		t.Fatalf("Expected the session to be stored at offset 4, got %+v", session)
+	}
+
+	var sent []int64
+	opts.Progress = func(n, total int64) { sent = append(sent, n) }
+	eTag, err := client.Upload(context.Background(), "bucket", "file.txt", bytes.NewReader(content), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eTag != vbase.ContentHash(content) {
+		t.Errorf("Expected ETag %s, got %s", vbase.ContentHash(content), eTag)
+	}
+	if len(sent) == 0 || sent[0] != 4 {
+		t.Errorf("Expected the upload to resume at offset 4, got progress %v", sent)
+	}
+
+	rc, _, err := fake.GetFile("bucket", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	stored, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Errorf("Expected %q to be stored, got %q", content, stored)
+	}
+}
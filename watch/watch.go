@@ -0,0 +1,244 @@
+// Package watch detects changes in VBase and Metadata buckets by polling their
+// hashes and diffing their listings.
+package watch
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vtex/go-clients/metadata"
+	"github.com/vtex/go-clients/vbase"
+)
+
+// EventType is the kind of change detected for an entry
+type EventType string
+
+const (
+	Added    = EventType("added")
+	Modified = EventType("modified")
+	Deleted  = EventType("deleted")
+)
+
+// Event is a change in a single bucket entry. Hash is empty for Deleted
+// events.
+type Event struct {
+	Type EventType
+	Key  string
+	Hash string
+}
+
+// Cursor is the state of a bucket as last seen by a Watcher. It can be
+// persisted, e.g. as JSON, and passed back in Options to resume watching the
+// bucket without reporting already seen changes.
+type Cursor struct {
+	BucketHash string            `json:"bucketHash"`
+	Hashes     map[string]string `json:"hashes"`
+}
+
+// Options configures a Watcher
+type Options struct {
+	// Prefix restricts a VBase watcher to files under a path prefix. It is
+	// ignored by Metadata watchers.
+	Prefix string
+	// Cursors resumes watching buckets from their previous states, by
+	// bucket. For buckets without a cursor, the first poll only records the
+	// bucket state without emitting events.
+	Cursors map[string]*Cursor
+	// MaxBackoff bounds the wait between polls after consecutive errors.
+	// Defaults to five minutes.
+	MaxBackoff time.Duration
+	// OnError, if set, is called with every polling error
+	OnError func(err error)
+}
+
+// Watcher polls buckets and reports their changes, keeping a cursor for each
+// watched bucket
+type Watcher struct {
+	source source
+	opts   Options
+
+	mu      sync.Mutex
+	cursors map[string]*Cursor
+}
+
+type source interface {
+	bucketHash(bucket string) (string, error)
+	hashes(bucket string) (map[string]string, error)
+}
+
+// NewVBaseWatcher creates a Watcher for VBase buckets
+func NewVBaseWatcher(client vbase.VBase, opts Options) *Watcher {
+	return newWatcher(&vbaseSource{client, opts.Prefix}, opts)
+}
+
+// NewMetadataWatcher creates a Watcher for Metadata buckets
+func NewMetadataWatcher(client metadata.Metadata, opts Options) *Watcher {
+	return newWatcher(&metadataSource{client}, opts)
+}
+
+func newWatcher(src source, opts Options) *Watcher {
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	cursors := make(map[string]*Cursor, len(opts.Cursors))
+	for bucket, cursor := range opts.Cursors {
+		cursors[bucket] = cursor
+	}
+	return &Watcher{source: src, opts: opts, cursors: cursors}
+}
+
+// Cursor returns the state of bucket after the last batch of its events that
+// was fully delivered, or nil if none was
+func (w *Watcher) Cursor(bucket string) *Cursor {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cursors[bucket]
+}
+
+// Watch polls bucket every interval and sends its changes to the returned
+// channel, which is closed when ctx is done.
+func (w *Watcher) Watch(ctx context.Context, bucket string, interval time.Duration) <-chan Event {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+
+		wait := time.Duration(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			changes, cursor, err := w.poll(bucket)
+			if err != nil {
+				if w.opts.OnError != nil {
+					w.opts.OnError(err)
+				}
+				wait = Backoff(wait, interval, w.opts.MaxBackoff)
+				continue
+			}
+			wait = interval
+
+			for _, e := range changes {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			w.mu.Lock()
+			w.cursors[bucket] = cursor
+			w.mu.Unlock()
+		}
+	}()
+	return events
+}
+
+func (w *Watcher) poll(bucket string) ([]Event, *Cursor, error) {
+	last := w.Cursor(bucket)
+
+	hash, err := w.source.bucketHash(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	if last != nil && last.BucketHash == hash {
+		return nil, last, nil
+	}
+
+	hashes, err := w.source.hashes(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	cursor := &Cursor{BucketHash: hash, Hashes: hashes}
+	if last == nil {
+		return nil, cursor, nil
+	}
+	return Diff(last.Hashes, hashes), cursor, nil
+}
+
+// Diff compares two sets of entry hashes, keyed by entry, returning the
+// changes from oldHashes to newHashes sorted by key
+func Diff(oldHashes, newHashes map[string]string) []Event {
+	var events []Event
+	for key, hash := range newHashes {
+		if oldHash, ok := oldHashes[key]; !ok {
+			events = append(events, Event{Type: Added, Key: key, Hash: hash})
+		} else if oldHash != hash {
+			events = append(events, Event{Type: Modified, Key: key, Hash: hash})
+		}
+	}
+	for key := range oldHashes {
+		if _, ok := newHashes[key]; !ok {
+			events = append(events, Event{Type: Deleted, Key: key})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
+
+// Backoff returns the wait before the next poll after an error, doubling the
+// last wait, starting from interval, up to max
+func Backoff(last, interval, max time.Duration) time.Duration {
+	if last < interval {
+		last = interval
+	}
+	if next := 2 * last; next < max {
+		return next
+	}
+	return max
+}
+
+type vbaseSource struct {
+	client vbase.VBase
+	prefix string
+}
+
+func (s *vbaseSource) bucketHash(bucket string) (string, error) {
+	res, _, err := s.client.GetBucket(bucket)
+	if err != nil {
+		return "", err
+	}
+	return res.Hash, nil
+}
+
+func (s *vbaseSource) hashes(bucket string) (map[string]string, error) {
+	list, _, err := s.client.ListAllFiles(bucket, s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string, len(list.Files))
+	for _, f := range list.Files {
+		hashes[f.Path] = f.Hash
+	}
+	return hashes, nil
+}
+
+type metadataSource struct {
+	client metadata.Metadata
+}
+
+func (s *metadataSource) bucketHash(bucket string) (string, error) {
+	res, _, err := s.client.GetBucket(bucket)
+	if err != nil {
+		return "", err
+	}
+	return res.Hash, nil
+}
+
+func (s *metadataSource) hashes(bucket string) (map[string]string, error) {
+	list, _, err := s.client.ListAll(bucket, false)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string, len(list.Data))
+	for _, entry := range list.Data {
+		hashes[entry.Key] = entry.Hash
+	}
+	return hashes, nil
+}